@@ -0,0 +1,55 @@
+package cuckoo
+
+import "fmt"
+
+// AndFilter holds the same items in two filters hashing with different seeds
+// and reports an item only when both do. Their false positives are
+// independent, so the false positive rate is the product of theirs, at the
+// memory of both
+type AndFilter struct {
+	a, b *Filter
+}
+
+// NewAndFilter returns an AndFilter over a and b, which must hash with different
+// seeds or hashes, see WithSeed and WithHash. Both should start empty
+func NewAndFilter(a, b *Filter) (*AndFilter, error) {
+	unlock := rlockBoth(a, b)
+	defer unlock()
+
+	if a.closed || b.closed {
+		return nil, ErrClosed
+	}
+
+	if a == b || a.hashID == b.hashID {
+		return nil, fmt.Errorf("filters must hash with different seeds or hashes")
+	}
+
+	return &AndFilter{a: a, b: b}, nil
+}
+
+// Insert inserts the item into both filters. If the second one can't take it,
+// it's deleted from the first so both keep holding the same items
+func (af *AndFilter) Insert(x []byte) bool {
+	if !af.a.Insert(x) {
+		return false
+	}
+
+	if !af.b.Insert(x) {
+		af.a.Delete(x)
+		return false
+	}
+
+	return true
+}
+
+// Lookup checks if the item exists in both filters
+func (af *AndFilter) Lookup(x []byte) bool {
+	return af.a.Lookup(x) && af.b.Lookup(x)
+}
+
+// Delete deletes the item from both filters, returning true if both held it
+func (af *AndFilter) Delete(x []byte) bool {
+	da := af.a.Delete(x)
+	db := af.b.Delete(x)
+	return da && db
+}
@@ -0,0 +1,59 @@
+package cuckoo
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAndFilter(t *testing.T) {
+	newFilter := func(s uint32) *Filter {
+		f, err := NewWithOptions(WithCapacity(1<<12), WithSeed(s))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return f
+	}
+
+	if _, err := NewAndFilter(newFilter(1), newFilter(1)); err == nil {
+		t.Fatalf("expected error for filters with the same seed")
+	}
+
+	a, b := newFilter(1), newFilter(2)
+	af, err := NewAndFilter(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		if !af.Insert([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("insert failed: item-%d", i)
+		}
+	}
+
+	// the combined false positives can't outnumber either filter's
+	var fa, fb, fab int
+	for i := 0; i < 100000; i++ {
+		x := []byte(fmt.Sprintf("missing-%d", i))
+		if a.Lookup(x) {
+			fa++
+		}
+
+		if b.Lookup(x) {
+			fb++
+		}
+
+		if af.Lookup(x) {
+			fab++
+		}
+	}
+
+	if fa == 0 || fb == 0 || fab > fa/10 || fab > fb/10 {
+		t.Fatalf("expected far fewer combined false positives than %d and %d but got %d", fa, fb, fab)
+	}
+
+	x := []byte("item-1")
+	if !af.Lookup(x) || !af.Delete(x) || af.Lookup(x) || a.Lookup(x) || b.Lookup(x) {
+		t.Fatalf("expected delete to remove the item from both filters")
+	}
+}
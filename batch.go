@@ -0,0 +1,150 @@
+package cuckoo
+
+import "fmt"
+
+// batchChunk is how many items a worker hashes at a time
+const batchChunk = 1 << 10
+
+// lookupChunk is how many items Missing hashes before probing their buckets
+const lookupChunk = 64
+
+// location of a batch item, or the error keying it
+type location struct {
+	x      []byte
+	fp     fingerprint
+	i1, i2 uint32
+	err    error
+}
+
+// locateAll keys and locates the items from workers goroutines. Placing them
+// depends on the order of the inserts, so only the hashing is split
+func locateAll(f *Filter, items [][]byte, workers int) []location {
+	locs := make([]location, len(items))
+	chunks := uint32((len(items) + batchChunk - 1) / batchChunk)
+	_ = parallel(chunks, workers, func(c uint32) error {
+		for i := int(c) * batchChunk; i < len(items) && i < int(c+1)*batchChunk; i++ {
+			l := &locs[i]
+			if l.x, l.err = keyOf(f, items[i]); l.err == nil {
+				l.fp, l.i1, l.i2 = locate(f, l.x)
+			}
+		}
+
+		return nil
+	})
+
+	return locs
+}
+
+// InsertBatchParallel inserts the items, returning how many were inserted.
+// The filter isn't sharded, so it holds the lock for the whole batch and
+// inserts in order, with workers goroutines hashing the items ahead of it.
+// ShardedFilter.InsertBatchParallel inserts into its shards in parallel
+func (f *Filter) InsertBatchParallel(items [][]byte, workers int) int {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertBatchParallel(items, workers)
+}
+
+// UInsertBatchParallel inserts the items, returning how many were inserted. Not thread safe
+func (f *Filter) UInsertBatchParallel(items [][]byte, workers int) int {
+	var n int
+	for _, l := range locateAll(f, items, workers) {
+		if l.err != nil {
+			continue
+		}
+
+		if err := insertAt(f, l.fp, l.i1, l.i2); err == nil || (canSpill(err) && spill(f, l.x)) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// InsertAll inserts all the items or none of them. If an item doesn't fit,
+// the items inserted before it are deleted again and ErrFilterFull is
+// returned. The filter then holds the fingerprints it held before, though
+// those kicked by the batch can be left in their other bucket. Empty items
+// fail it with ErrInvalidInput before anything is inserted. Items aren't
+// spilled to the overflow bloom filter, which can't take them back
+func (f *Filter) InsertAll(items [][]byte) error {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertAll(items)
+}
+
+// UInsertAll inserts all the items or none of them. Not thread safe
+func (f *Filter) UInsertAll(items [][]byte) error {
+	locs := locateAll(f, items, 1)
+	for i, l := range locs {
+		if l.err != nil {
+			return fmt.Errorf("item %d: %w", i, l.err)
+		}
+	}
+
+	for i, l := range locs {
+		err := insertAt(f, l.fp, l.i1, l.i2)
+		if err == nil {
+			continue
+		}
+
+		// copies of a fingerprint in the same buckets can't be told apart, so
+		// deleting any of them takes back the one inserted
+		for j := i - 1; j >= 0; j-- {
+			l := locs[j]
+			if dropRef(f, l.fp, l.i1, l.i2) {
+				continue
+			}
+
+			if deleteFrom(&f.buckets[l.i1], f.bucketSize, l.fp) || deleteFrom(&f.buckets[l.i2], f.bucketSize, l.fp) {
+				dropCount(f, 1)
+			}
+		}
+
+		return fmt.Errorf("item %d: %w", i, fitError(err))
+	}
+
+	return nil
+}
+
+// InsertMany inserts the items under a single hold of the lock, returning how
+// many were inserted and whether all of them were. Each item is inserted as
+// Insert would, so items it rejects, like empty ones, are skipped
+func (f *Filter) InsertMany(items [][]byte) (inserted int, ok bool) {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertMany(items)
+}
+
+// UInsertMany inserts the items, returning how many were inserted and whether all of them were. Not thread safe
+func (f *Filter) UInsertMany(items [][]byte) (inserted int, ok bool) {
+	for _, x := range items {
+		if f.UInsert(x) {
+			inserted++
+		}
+	}
+
+	return inserted, inserted == len(items)
+}
+
+// LookupMany looks up the items under a single hold of the read lock,
+// returning whether each one exists in the filter
+func (f *Filter) LookupMany(items [][]byte) []bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.ULookupMany(items)
+}
+
+// ULookupMany returns whether each of the items exists in the filter. Not thread safe
+func (f *Filter) ULookupMany(items [][]byte) []bool {
+	found := make([]bool, len(items))
+	for i, x := range items {
+		found[i] = f.ULookup(x)
+	}
+
+	return found
+}
@@ -0,0 +1,102 @@
+package cuckoo
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestFilter_InsertBatchParallel(t *testing.T) {
+	var items [][]byte
+	for i := 0; i < 5000; i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	items = append(items, nil)
+	for _, workers := range []int{0, 1, 4} {
+		a, _ := NewWithOptions(WithCapacity(1<<12), WithRandSource(rand.NewSource(1)))
+		b, _ := NewWithOptions(WithCapacity(1<<12), WithRandSource(rand.NewSource(1)))
+		var n int
+		for _, x := range items {
+			if a.Insert(x) {
+				n++
+			}
+		}
+
+		if got := b.InsertBatchParallel(items, workers); got != n {
+			t.Fatalf("expected %d inserted with %d workers but got %d", n, workers, got)
+		}
+
+		if a.Count() != b.Count() || !reflect.DeepEqual(a.buckets, b.buckets) {
+			t.Fatalf("expected the same buckets as inserting in order with %d workers", workers)
+		}
+	}
+}
+
+func TestFilter_InsertAll(t *testing.T) {
+	f := NewFilter(4000)
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	if err := f.InsertAll(items); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	count, fps := f.Count(), fingerprintMultiset(f)
+	var more [][]byte
+	for i := 0; i < 5000; i++ {
+		more = append(more, []byte(fmt.Sprintf("more-%d", i)))
+	}
+
+	if err := f.InsertAll(more); !errors.Is(err, ErrFilterFull) {
+		t.Fatalf("expected %v but got %v", ErrFilterFull, err)
+	}
+
+	if err := f.InsertAll(append(more[:10:10], nil)); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected %v but got %v", ErrInvalidInput, err)
+	}
+
+	if f.Count() != count || !reflect.DeepEqual(fingerprintMultiset(f), fps) {
+		t.Fatalf("expected failed batches to leave the fingerprints as they were")
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed after rollback: %s", x)
+		}
+	}
+}
+
+func TestFilter_InsertManyLookupMany(t *testing.T) {
+	f := NewFilter(1 << 12)
+	items := [][]byte{[]byte("a"), []byte("b"), nil, []byte("c")}
+	if n, ok := f.InsertMany(items); n != 3 || ok {
+		t.Fatalf("expected 3 of 4 inserted but got %d, %t", n, ok)
+	}
+
+	if n, ok := f.InsertMany(items[:2]); n != 2 || !ok {
+		t.Fatalf("expected all inserted but got %d, %t", n, ok)
+	}
+
+	items = append(items, []byte("missing"))
+	expected := []bool{true, true, false, true, false}
+	if found := f.LookupMany(items); !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected %v but got %v", expected, found)
+	}
+
+	for i, x := range items {
+		if f.Lookup(x) != expected[i] {
+			t.Fatalf("expected LookupMany to match Lookup for %q", x)
+		}
+	}
+}
@@ -0,0 +1,897 @@
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// Binary format of a filter, all integers big endian:
+//
+//	header: magic "CKOO" | version uint8 | flags uint8 | bucket size uint8 | fingerprint bits uint8 |
+//	        total buckets uint32 | count uint32 | max kicks uint16 | hash id uint16 |
+//	        chunk buckets uint32 | seed uint32 | crc32 of the preceding bytes
+//	chunks: chunk buckets buckets (fewer in the last chunk) of Track uint16 and
+//	        bucket size fingerprints each, followed by the crc32 of the chunk
+//
+// Every bucket has the same size, so the offset of any chunk follows from the
+// header and chunks can be written and read independently. The hash id is the
+// low 16 bits of the hashIDOf a WithHash hash, set with flagCustomHash.
+//
+// With flagRunLength the chunks are run length encoded instead, as
+//
+//	chunk:  length uint32 | runs | crc32 of the length and runs
+//	runs:   empty buckets uvarint | Track uint16 | its set fingerprints, ...
+//
+// each run of empty buckets followed by the occupied bucket ending it, except
+// for a trailing run. Chunks then vary in size and are read in order
+const (
+	formatMagic   = "CKOO"
+	formatVersion = 2
+	headerSize    = 32
+	chunkBuckets  = 1 << 12
+)
+
+// flags of the binary format
+const (
+	// flagLengthPrefix is set when keys are hashed with their length prefixed
+	flagLengthPrefix uint8 = 1 << iota
+
+	// flagLittleEndian is set when fingerprints are read little endian
+	flagLittleEndian
+
+	// flagPartialKeyIndexing is set for filters using PartialKeyIndexing
+	flagPartialKeyIndexing
+
+	// flagStrictKeys is set when keys are hashed without padding
+	flagStrictKeys
+
+	// flagRunLength is set when the chunks are run length encoded
+	flagRunLength
+
+	// flagAltSeedIndexing is set for filters using AltSeedIndexing
+	flagAltSeedIndexing
+
+	// flagCustomHash is set for filters hashing with a WithHash hash
+	flagCustomHash
+
+	knownFlags = flagLengthPrefix | flagLittleEndian | flagPartialKeyIndexing | flagStrictKeys | flagRunLength |
+		flagAltSeedIndexing | flagCustomHash
+)
+
+// errOverflowFormat is returned when a filter with an overflow bloom filter is written in the binary format
+var errOverflowFormat = errors.New("binary format doesn't carry the overflow bloom filter")
+
+// header of the binary format
+type header struct {
+	flags        uint8
+	bucketSize   uint8
+	fpBits       uint8
+	totalBuckets uint32
+	count        uint32
+	maxKicks     uint16
+	chunkBuckets uint32
+	seed         uint32
+	hashID       uint16
+}
+
+// headerOf returns the header of the filter
+func headerOf(f *Filter) header {
+	h := header{
+		seed:         f.seed,
+		bucketSize:   f.bucketSize,
+		fpBits:       fingerprintBits,
+		totalBuckets: f.totalBuckets,
+		count:        f.count.Load(),
+		maxKicks:     f.maxKicks,
+		chunkBuckets: chunkBuckets,
+	}
+
+	if f.lengthPrefix {
+		h.flags |= flagLengthPrefix
+	}
+
+	if f.order == binary.LittleEndian {
+		h.flags |= flagLittleEndian
+	}
+
+	switch f.indexing {
+	case PartialKeyIndexing:
+		h.flags |= flagPartialKeyIndexing
+	case AltSeedIndexing:
+		h.flags |= flagAltSeedIndexing
+	}
+
+	if f.strictKeys {
+		h.flags |= flagStrictKeys
+	}
+
+	if f.customHash {
+		h.flags |= flagCustomHash
+		h.hashID = uint16(f.hashID)
+	}
+
+	return h
+}
+
+// bucketBytes returns the encoded size of a bucket
+func (h header) bucketBytes() int64 {
+	return 2 * (1 + int64(h.bucketSize))
+}
+
+// chunks returns the number of chunks, computed in 64 bits so the rounding up
+// can't wrap around
+func (h header) chunks() uint32 {
+	return uint32((uint64(h.totalBuckets) + uint64(h.chunkBuckets) - 1) / uint64(h.chunkBuckets))
+}
+
+// chunk returns the first bucket, the number of buckets and the offset of chunk c
+func (h header) chunk(c uint32) (first, n uint32, off int64) {
+	first = c * h.chunkBuckets
+	n = min(h.chunkBuckets, h.totalBuckets-first)
+
+	return first, n, headerSize + int64(c)*(int64(h.chunkBuckets)*h.bucketBytes()+4)
+}
+
+// minSize returns the fewest bytes a filter with the header encodes to. Run
+// length encoded chunks take at least their length, a run and their checksum
+func (h header) minSize() int64 {
+	if h.flags&flagRunLength != 0 {
+		return headerSize + int64(h.chunks())*(4+1+4)
+	}
+
+	return headerSize + int64(h.totalBuckets)*h.bucketBytes() + int64(h.chunks())*4
+}
+
+// encode returns the encoded header
+func (h header) encode() []byte {
+	b := make([]byte, headerSize)
+	copy(b, formatMagic)
+	b[4] = formatVersion
+	b[5] = h.flags
+	b[6] = h.bucketSize
+	b[7] = h.fpBits
+	binary.BigEndian.PutUint32(b[8:], h.totalBuckets)
+	binary.BigEndian.PutUint32(b[12:], h.count)
+	binary.BigEndian.PutUint16(b[16:], h.maxKicks)
+	binary.BigEndian.PutUint16(b[18:], h.hashID)
+	binary.BigEndian.PutUint32(b[20:], h.chunkBuckets)
+	binary.BigEndian.PutUint32(b[24:], h.seed)
+	binary.BigEndian.PutUint32(b[28:], crc32.ChecksumIEEE(b[:28]))
+	return b
+}
+
+// decodeHeader decodes and validates the header in b
+func decodeHeader(b []byte) (h header, err error) {
+	if len(b) < headerSize {
+		return h, fmt.Errorf("header needs %d bytes but got %d", headerSize, len(b))
+	}
+
+	if string(b[:4]) != formatMagic {
+		return h, fmt.Errorf("not a cuckoo filter")
+	}
+
+	if b[4] != formatVersion {
+		return h, fmt.Errorf("unsupported format version %d", b[4])
+	}
+
+	if crc32.ChecksumIEEE(b[:headerSize-4]) != binary.BigEndian.Uint32(b[headerSize-4:]) {
+		return h, fmt.Errorf("header checksum mismatch")
+	}
+
+	h = header{
+		seed:         binary.BigEndian.Uint32(b[24:]),
+		flags:        b[5],
+		bucketSize:   b[6],
+		fpBits:       b[7],
+		totalBuckets: binary.BigEndian.Uint32(b[8:]),
+		count:        binary.BigEndian.Uint32(b[12:]),
+		maxKicks:     binary.BigEndian.Uint16(b[16:]),
+		hashID:       binary.BigEndian.Uint16(b[18:]),
+		chunkBuckets: binary.BigEndian.Uint32(b[20:]),
+	}
+
+	if h.flags&^knownFlags != 0 {
+		return h, fmt.Errorf("unsupported flags %#x", h.flags)
+	}
+
+	if h.flags&flagPartialKeyIndexing != 0 && h.flags&flagAltSeedIndexing != 0 {
+		return h, fmt.Errorf("more than one indexing scheme in flags %#x", h.flags)
+	}
+
+	if h.bucketSize == 0 || h.bucketSize > maxBucketSize {
+		return h, fmt.Errorf("doesn't support %d bucket size. Max bucket size is %d", h.bucketSize, maxBucketSize)
+	}
+
+	if h.fpBits != fingerprintBits {
+		return h, fmt.Errorf("doesn't support %d-bit fingerprints, only %d-bit", h.fpBits, fingerprintBits)
+	}
+
+	if h.totalBuckets == 0 || h.chunkBuckets == 0 || uint64(h.chunks())*uint64(h.chunkBuckets) < uint64(h.totalBuckets) {
+		return h, fmt.Errorf("invalid geometry of %d buckets in chunks of %d", h.totalBuckets, h.chunkBuckets)
+	}
+
+	return h, nil
+}
+
+// config returns the configuration of the filter the header describes
+func (h header) config() Config {
+	c := Config{
+		BucketSize:      h.bucketSize,
+		TotalBuckets:    h.totalBuckets,
+		MaxKicks:        h.maxKicks,
+		Seed:            h.seed,
+		FingerprintBits: h.fpBits,
+		ByteOrder:       binary.BigEndian,
+		LengthPrefix:    h.flags&flagLengthPrefix != 0,
+		StrictKeys:      h.flags&flagStrictKeys != 0,
+	}
+
+	if h.flags&flagLittleEndian != 0 {
+		c.ByteOrder = binary.LittleEndian
+	}
+
+	switch {
+	case h.flags&flagPartialKeyIndexing != 0:
+		c.Indexing = PartialKeyIndexing
+	case h.flags&flagAltSeedIndexing != 0:
+		c.Indexing = AltSeedIndexing
+	}
+
+	return c
+}
+
+// encodeChunk returns the encoded buckets followed by their checksum
+func encodeChunk(buckets []bucket, bs uint8) []byte {
+	b := make([]byte, 0, len(buckets)*2*(1+int(bs))+4)
+	for _, bk := range buckets {
+		b = binary.BigEndian.AppendUint16(b, bk.Track)
+		for _, fp := range bk.FPs {
+			b = binary.BigEndian.AppendUint16(b, fp)
+		}
+	}
+
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// decodeChunk verifies the checksum of the chunk in b and decodes it into buckets
+func decodeChunk(b []byte, buckets []bucket, bs uint8) error {
+	data, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(data) != sum {
+		return fmt.Errorf("chunk checksum mismatch")
+	}
+
+	for i := range buckets {
+		track := binary.BigEndian.Uint16(data)
+		if bs < 16 && track>>bs != 0 {
+			return fmt.Errorf("invalid occupancy %#x of bucket %d", track, i)
+		}
+
+		buckets[i].Track = track
+		data = data[2:]
+		for j := uint8(0); j < bs; j++ {
+			buckets[i].FPs[j] = binary.BigEndian.Uint16(data)
+			data = data[2:]
+		}
+	}
+
+	return nil
+}
+
+// maxRunLengthChunk returns the longest run length encoding of n buckets,
+// past its length, a run before every bucket and a trailing one
+func (h header) maxRunLengthChunk(n uint32) int64 {
+	return int64(n+1)*binary.MaxVarintLen32 + int64(n)*h.bucketBytes()
+}
+
+// encodeRunLengthChunk returns the run length encoded buckets, prefixed with
+// their length and followed by their checksum
+func encodeRunLengthChunk(buckets []bucket, bs uint8) []byte {
+	b := make([]byte, 4, 64)
+	for i := 0; i < len(buckets); i++ {
+		var empty uint64
+		for ; i < len(buckets) && buckets[i].Track == 0; i++ {
+			empty++
+		}
+
+		b = binary.AppendUvarint(b, empty)
+		if i == len(buckets) {
+			break
+		}
+
+		b = binary.BigEndian.AppendUint16(b, buckets[i].Track)
+		for j := uint8(0); j < bs; j++ {
+			if isSet(buckets[i].Track, j) {
+				b = binary.BigEndian.AppendUint16(b, buckets[i].FPs[j])
+			}
+		}
+	}
+
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// decodeRunLengthChunk verifies the checksum of the run length encoded chunk in
+// b, its length included, and decodes it into empty buckets
+func decodeRunLengthChunk(b []byte, buckets []bucket, bs uint8) error {
+	data, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(data) != sum {
+		return fmt.Errorf("chunk checksum mismatch")
+	}
+
+	data = data[4:]
+	for i := 0; i < len(buckets); i++ {
+		empty, n := binary.Uvarint(data)
+		if n <= 0 || empty > uint64(len(buckets)-i) {
+			return fmt.Errorf("malformed run of empty buckets at bucket %d", i)
+		}
+
+		data, i = data[n:], i+int(empty)
+		if i == len(buckets) {
+			break
+		}
+
+		if len(data) < 2 {
+			return fmt.Errorf("chunk ends at bucket %d", i)
+		}
+
+		track := binary.BigEndian.Uint16(data)
+		data = data[2:]
+		if track == 0 || bs < 16 && track>>bs != 0 {
+			return fmt.Errorf("invalid occupancy %#x of bucket %d", track, i)
+		}
+
+		buckets[i].Track = track
+		for j := uint8(0); j < bs; j++ {
+			if !isSet(track, j) {
+				continue
+			}
+
+			if len(data) < 2 {
+				return fmt.Errorf("chunk ends at bucket %d", i)
+			}
+
+			buckets[i].FPs[j] = binary.BigEndian.Uint16(data)
+			data = data[2:]
+		}
+	}
+
+	if len(data) != 0 {
+		return fmt.Errorf("%d bytes past the last bucket", len(data))
+	}
+
+	return nil
+}
+
+// readRunLength reads the run length encoded chunks of h from r into buckets
+func readRunLength(r io.ReaderAt, h header, buckets []bucket) error {
+	off := int64(headerSize)
+	var lb [4]byte
+	for c := uint32(0); c < h.chunks(); c++ {
+		first, n, _ := h.chunk(c)
+		if m, err := r.ReadAt(lb[:], off); m < len(lb) {
+			return fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		size := int64(binary.BigEndian.Uint32(lb[:]))
+		if size > h.maxRunLengthChunk(n) {
+			return fmt.Errorf("failed to read chunk %d: %d bytes exceed the %d of its buckets", c, size, h.maxRunLengthChunk(n))
+		}
+
+		buf := make([]byte, 4+size+4)
+		if m, err := r.ReadAt(buf, off); m < len(buf) {
+			return fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		if err := decodeRunLengthChunk(buf, buckets[first:first+n], h.bucketSize); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		off += int64(len(buf))
+	}
+
+	return nil
+}
+
+// parallel calls fn for every chunk from workers goroutines and returns the first error
+func parallel(chunks uint32, workers int, fn func(c uint32) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for c := uint32(w); c < chunks; c += uint32(workers) {
+				if err := fn(c); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteToParallel writes the filter in the binary format to w, with workers
+// goroutines writing disjoint chunks of buckets at their offsets
+func (f *Filter) WriteToParallel(w io.WriterAt, workers int) error {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+
+	if f.overflow != nil {
+		return errOverflowFormat
+	}
+
+	h := headerOf(f)
+	if _, err := w.WriteAt(h.encode(), 0); err != nil {
+		return fmt.Errorf("failed to write header: %v", err)
+	}
+
+	return parallel(h.chunks(), workers, func(c uint32) error {
+		first, n, off := h.chunk(c)
+		if _, err := w.WriteAt(encodeChunk(f.buckets[first:first+n], h.bucketSize), off); err != nil {
+			return fmt.Errorf("failed to write chunk %d: %v", c, err)
+		}
+
+		return nil
+	})
+}
+
+// LoadOption configures how Decode and ReadFromParallel load a filter
+type LoadOption func(o *loadOptions)
+
+// loadOptions holds what the load functions are configured by
+type loadOptions struct {
+	strict  bool
+	hashers *sync.Pool
+}
+
+// loadOptionsOf returns the load options opts configure
+func loadOptionsOf(opts []LoadOption) loadOptions {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// WithStrictLoad fails loading a filter whose stored count doesn't match
+// the fingerprints it holds with ErrCountMismatch, catching tampered or
+// corrupt snapshots. Without it the count is corrected
+func WithStrictLoad() LoadOption {
+	return func(o *loadOptions) {
+		o.strict = true
+	}
+}
+
+// WithLoadHash loads a filter stored with the WithHash hash newHash. Loading
+// fails with ErrHashMismatch if the filter was stored with another hash,
+// telling hashes apart by an id of theirs, or with murmur3
+func WithLoadHash(newHash func() hash.Hash32) LoadOption {
+	return func(o *loadOptions) {
+		if newHash != nil {
+			o.hashers = hasherPool(newHash)
+		}
+	}
+}
+
+// loadHash returns the hashers of WithLoadHash for a filter stored with a
+// WithHash hash, custom, whose hashIDOf masked by mask is id, or nil for one
+// stored with murmur3. Fails with ErrHashMismatch unless the hashers are of
+// the stored hash
+func loadHash(custom bool, id, mask uint32, opts []LoadOption) (*sync.Pool, error) {
+	o := loadOptionsOf(opts)
+	switch {
+	case o.hashers == nil && custom:
+		return nil, fmt.Errorf("%w: stored with a custom hash, load it WithLoadHash", ErrHashMismatch)
+	case o.hashers != nil && !custom:
+		return nil, fmt.Errorf("%w: stored with murmur3", ErrHashMismatch)
+	case custom && hashIDOf(o.hashers)&mask != id:
+		return nil, fmt.Errorf("%w: stored with hash id %#x", ErrHashMismatch, id)
+	}
+
+	return o.hashers, nil
+}
+
+// setHash hashes f with the hashers returned by loadHash, if any. Not thread safe
+func setHash(f *Filter, hashers *sync.Pool) {
+	if hashers != nil {
+		f.hashers, f.hashID, f.customHash = hashers, hashIDOf(hashers), true
+	}
+}
+
+// loadCount sets the count of a loaded filter to its occupied slots,
+// failing if they differ from the stored count under WithStrictLoad
+func loadCount(f *Filter, stored uint32, opts []LoadOption) error {
+	o := loadOptionsOf(opts)
+	var n uint32
+	for _, b := range f.buckets {
+		n += uint32(bits.OnesCount16(b.Track))
+	}
+
+	if o.strict && n != stored {
+		return fmt.Errorf("%w: stored %d but holds %d", ErrCountMismatch, stored, n)
+	}
+
+	f.count.Store(n)
+	return nil
+}
+
+// ReadFromParallel reads a filter written by WriteToParallel, with workers
+// goroutines reading disjoint chunks of buckets. Run length encoded chunks
+// don't have fixed offsets, so they're read in order by the calling goroutine.
+// The count is recomputed from the stored fingerprints, see WithStrictLoad.
+// If r has a Size method, like a bytes.Reader, a header claiming more buckets
+// than r can hold fails before the buckets are allocated
+func ReadFromParallel(r io.ReaderAt, workers int, opts ...LoadOption) (*Filter, error) {
+	hb := make([]byte, headerSize)
+	if _, err := r.ReadAt(hb, 0); err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+
+	h, err := decodeHeader(hb)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := r.(interface{ Size() int64 }); ok && s.Size() < h.minSize() {
+		return nil, fmt.Errorf("%d buckets of size %d need at least %d bytes but got %d",
+			h.totalBuckets, h.bucketSize, h.minSize(), s.Size())
+	}
+
+	hashers, err := loadHash(h.flags&flagCustomHash != 0, uint32(h.hashID), 0xffff, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := NewFilterFromConfig(h.config())
+	if err != nil {
+		return nil, err
+	}
+
+	setHash(f, hashers)
+	if h.flags&flagRunLength != 0 {
+		if err := readRunLength(r, h, f.buckets); err != nil {
+			return nil, err
+		}
+
+		if err := loadCount(f, h.count, opts); err != nil {
+			return nil, err
+		}
+
+		return f, nil
+	}
+
+	err = parallel(h.chunks(), workers, func(c uint32) error {
+		first, n, off := h.chunk(c)
+		buf := make([]byte, int64(n)*h.bucketBytes()+4)
+		if m, err := r.ReadAt(buf, off); m < len(buf) {
+			return fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		if err := decodeChunk(buf, f.buckets[first:first+n], h.bucketSize); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadCount(f, h.count, opts); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ValidateSnapshot reads a filter in the binary format from r, verifying its
+// header and the checksum of every chunk, and returns its configuration. The
+// chunks are checksummed as they stream by, so it needs no memory for the buckets
+func ValidateSnapshot(r io.Reader) (Config, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var sum [4]byte
+	for c := uint32(0); c < h.chunks(); c++ {
+		_, n, _ := h.chunk(c)
+		crc := crc32.NewIEEE()
+		size := int64(n) * h.bucketBytes()
+		if h.flags&flagRunLength != 0 {
+			if _, err := io.ReadFull(r, sum[:]); err != nil {
+				return Config{}, fmt.Errorf("failed to read chunk %d: %v", c, err)
+			}
+
+			crc.Write(sum[:])
+			if size = int64(binary.BigEndian.Uint32(sum[:])); size > h.maxRunLengthChunk(n) {
+				return Config{}, fmt.Errorf("failed to read chunk %d: %d bytes exceed the %d of its buckets",
+					c, size, h.maxRunLengthChunk(n))
+			}
+		}
+
+		if _, err := io.CopyN(crc, r, size); err != nil {
+			return Config{}, fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return Config{}, fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+
+		if crc.Sum32() != binary.BigEndian.Uint32(sum[:]) {
+			return Config{}, fmt.Errorf("failed to read chunk %d: chunk checksum mismatch", c)
+		}
+	}
+
+	return h.config(), nil
+}
+
+// appendBinary appends the filter in the binary format to b. Not thread safe
+func appendBinary(f *Filter, b []byte) ([]byte, error) {
+	h, chunk, err := binaryLayout(f)
+	if err != nil {
+		return nil, err
+	}
+
+	b = append(b, h.encode()...)
+	for c := uint32(0); c < h.chunks(); c++ {
+		b = append(b, chunk(c)...)
+	}
+
+	return b, nil
+}
+
+// binaryLayout returns the header of f in the binary format and a function
+// encoding its chunk c. Only the last chunk can be short, so the chunks
+// follow each other. Below the sparse load most buckets are empty, which run
+// length encoding skips
+func binaryLayout(f *Filter) (header, func(c uint32) []byte, error) {
+	if f.closed {
+		return header{}, nil, ErrClosed
+	}
+
+	if f.overflow != nil {
+		return header{}, nil, errOverflowFormat
+	}
+
+	h := headerOf(f)
+	rle := f.ULoadFactor() < sparseLoadFactor
+	if rle {
+		h.flags |= flagRunLength
+	}
+
+	return h, func(c uint32) []byte {
+		first, n, _ := h.chunk(c)
+		if rle {
+			return encodeRunLengthChunk(f.buckets[first:first+n], h.bucketSize)
+		}
+
+		return encodeChunk(f.buckets[first:first+n], h.bucketSize)
+	}, nil
+}
+
+// WriteTo writes the filter in the binary format to w a chunk of buckets at
+// a time, so it's never held in memory whole, and returns the bytes written
+func (f *Filter) WriteTo(w io.Writer) (int64, error) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	h, chunk, err := binaryLayout(f)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(h.encode())
+	written := int64(n)
+	if err != nil {
+		return written, fmt.Errorf("failed to write header: %v", err)
+	}
+
+	for c := uint32(0); c < h.chunks(); c++ {
+		n, err := w.Write(chunk(c))
+		written += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("failed to write chunk %d: %v", c, err)
+		}
+	}
+
+	return written, nil
+}
+
+// ReadFrom reads a filter in the binary format from r a chunk of buckets at
+// a time, like one written by WriteTo. Buckets are allocated as their chunks
+// are read, so a stream ending early fails having allocated only the buckets
+// read before it. The count is recomputed from the stored fingerprints, see
+// WithStrictLoad
+func ReadFrom(r io.Reader, opts ...LoadOption) (*Filter, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := h.config()
+	if err := validateConfig(conf); err != nil {
+		return nil, err
+	}
+
+	hashers, err := loadHash(h.flags&flagCustomHash != 0, uint32(h.hashID), 0xffff, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rle := h.flags&flagRunLength != 0
+	var lb [4]byte
+	var buckets []bucket
+	for c := uint32(0); c < h.chunks(); c++ {
+		first, n, _ := h.chunk(c)
+		var buf []byte
+		if rle {
+			if _, err := io.ReadFull(r, lb[:]); err != nil {
+				return nil, fmt.Errorf("failed to read chunk %d after %d buckets: %v", c, first, err)
+			}
+
+			size := int64(binary.BigEndian.Uint32(lb[:]))
+			if size > h.maxRunLengthChunk(n) {
+				return nil, fmt.Errorf("failed to read chunk %d: %d bytes exceed the %d of its buckets", c, size, h.maxRunLengthChunk(n))
+			}
+
+			buf = make([]byte, 4+size+4)
+			copy(buf, lb[:])
+			_, err = io.ReadFull(r, buf[4:])
+		} else {
+			buf = make([]byte, int64(n)*h.bucketBytes()+4)
+			_, err = io.ReadFull(r, buf)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %d after %d buckets: %v", c, first, err)
+		}
+
+		buckets = append(buckets, initBuckets(n, h.bucketSize)...)
+		if rle {
+			err = decodeRunLengthChunk(buf, buckets[first:first+n], h.bucketSize)
+		} else {
+			err = decodeChunk(buf, buckets[first:first+n], h.bucketSize)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk %d: %v", c, err)
+		}
+	}
+
+	f := filterFromConfig(conf, buckets)
+	setHash(f, hashers)
+	if err := loadCount(f, h.count, opts); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// readHeader reads and decodes the header of the binary format from r,
+// reading no further than its end
+func readHeader(r io.Reader) (header, error) {
+	hb := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, hb); err != nil {
+		return header{}, fmt.Errorf("failed to read header: %v", err)
+	}
+
+	return decodeHeader(hb)
+}
+
+// MarshalBinary returns the filter in the binary format, holding its
+// configuration and every bucket, to snapshot it to disk
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return appendBinary(f, nil)
+}
+
+// UnmarshalBinary replaces the filter with the one in data from
+// MarshalBinary. Data not matching the geometry of its header, like a
+// truncated snapshot, fails it and leaves the filter as it was. A filter with
+// a WithHash hash takes data stored with that hash. Options the format
+// doesn't carry, like WithKeyTransform, WithMaxKeySize or WithEvictionHook,
+// are kept, and the filter's overflow bloom filter and references are emptied
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	f.L.RLock()
+	closed, custom, hashers := f.closed, f.customHash, f.hashers
+	f.L.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	var opts []LoadOption
+	if custom {
+		opts = append(opts, func(o *loadOptions) { o.hashers = hashers })
+	}
+
+	nf, err := ReadFromParallel(bytes.NewReader(data), 1, opts...)
+	if err != nil {
+		return err
+	}
+
+	return f.load(nf)
+}
+
+// MarshalText returns the binary format of the filter base64 encoded, to embed
+// small filters in text config. JSON encodes the summary of MarshalJSON
+// instead, so embed the text as a string there
+func (f *Filter) MarshalText() ([]byte, error) {
+	b, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(text, b)
+	return text, nil
+}
+
+// UnmarshalText replaces the filter with the one in text from MarshalText
+func (f *Filter) UnmarshalText(text []byte) error {
+	if isClosed(f) {
+		return ErrClosed
+	}
+
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(b, text)
+	if err != nil {
+		return fmt.Errorf("failed to decode filter: %v", err)
+	}
+
+	return f.UnmarshalBinary(b[:n])
+}
+
+// filterSummary is the JSON summary of a filter, see MarshalJSON
+type filterSummary struct {
+	Count           uint32  `json:"count"`
+	BucketSize      uint8   `json:"bucketSize"`
+	TotalBuckets    uint32  `json:"totalBuckets"`
+	MaxKicks        uint16  `json:"maxKicks"`
+	FingerprintBits uint8   `json:"fingerprintBits"`
+	LoadFactor      float64 `json:"loadFactor"`
+}
+
+// MarshalJSON returns a summary of the configuration and load of the filter
+// for logs and metrics, taken under the read lock. It holds no buckets, so it
+// can't be unmarshaled back into a filter, see MarshalText for that
+func (f *Filter) MarshalJSON() ([]byte, error) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return json.Marshal(filterSummary{
+		Count:           f.UCount(),
+		BucketSize:      f.bucketSize,
+		TotalBuckets:    f.totalBuckets,
+		MaxKicks:        f.maxKicks,
+		FingerprintBits: fingerprintBits,
+		LoadFactor:      f.ULoadFactor(),
+	})
+}
@@ -0,0 +1,563 @@
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFilter_WriteReadParallel(t *testing.T) {
+	f := NewFilter(1 << 16)
+	var items [][]byte
+	for i := 0; i < 1<<14; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		f.Insert(x)
+		items = append(items, x)
+	}
+
+	path := filepath.Join(t.TempDir(), "filter")
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fd.Close()
+
+	if err := f.WriteToParallel(fd, 4); err != nil {
+		t.Fatalf("unexpected error while writing: %v", err)
+	}
+
+	for _, workers := range []int{0, 1, 3, 8} {
+		df, err := ReadFromParallel(fd, workers)
+		if err != nil {
+			t.Fatalf("unexpected error while reading with %d workers: %v", workers, err)
+		}
+
+		if df.Count() != f.Count() || df.maxKicks != f.maxKicks || !reflect.DeepEqual(f.buckets, df.buckets) {
+			t.Fatalf("filter mismatch reading with %d workers", workers)
+		}
+
+		for _, x := range items {
+			if !df.Lookup(x) {
+				t.Fatalf("lookup failed: %s", x)
+			}
+		}
+	}
+
+	// flip a fingerprint in the last chunk
+	info, _ := fd.Stat()
+	if _, err := fd.WriteAt([]byte{0xff}, info.Size()-10); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := ReadFromParallel(fd, 2); err == nil {
+		t.Fatalf("expected checksum error")
+	}
+
+	if err := fd.Truncate(info.Size() / 2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := ReadFromParallel(fd, 2); err == nil {
+		t.Fatalf("expected error reading a truncated filter")
+	}
+}
+
+func TestFilter_MarshalText(t *testing.T) {
+	f := NewFilter(1 << 8)
+	for i := 0; i < 100; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	text, err := f.MarshalText()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// JSON takes MarshalJSON, so the text is embedded as a string
+	cfg := struct {
+		Filter string `json:"filter"`
+	}{Filter: string(text)}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg.Filter = ""
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	df := new(Filter)
+	if err := df.UnmarshalText([]byte(cfg.Filter)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if df.Count() != f.Count() || !reflect.DeepEqual(f.buckets, df.buckets) {
+		t.Fatalf("filter mismatch after round trip")
+	}
+
+	for i := 0; i < 100; i++ {
+		if !df.Lookup([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("lookup failed: item-%d", i)
+		}
+	}
+
+	if err := df.UnmarshalText([]byte("not base64!")); err == nil {
+		t.Fatalf("expected error for invalid text")
+	}
+}
+
+func TestFilter_MarshalJSON(t *testing.T) {
+	f, _ := NewWithOptions(WithCapacity(1<<10), WithBucketSize(4), WithMaxKicks(100))
+	for i := 0; i < 100; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]any{
+		"count":           float64(100),
+		"bucketSize":      float64(4),
+		"totalBuckets":    float64(f.totalBuckets),
+		"maxKicks":        float64(100),
+		"fingerprintBits": float64(fingerprintBits),
+		"loadFactor":      f.LoadFactor(),
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v but got %v", expected, got)
+	}
+
+	if err := json.Unmarshal(b, new(Filter)); err == nil {
+		t.Fatalf("expected error unmarshaling the summary into a filter")
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<15), WithSeed(7), WithByteOrder(binary.LittleEndian),
+		WithIndexing(PartialKeyIndexing))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	b, err := appendBinary(f, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c, err := ValidateSnapshot(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := Config{
+		BucketSize:      f.bucketSize,
+		TotalBuckets:    f.totalBuckets,
+		MaxKicks:        f.maxKicks,
+		Seed:            7,
+		FingerprintBits: fingerprintBits,
+		ByteOrder:       binary.LittleEndian,
+		Indexing:        PartialKeyIndexing,
+	}
+
+	if c != expected {
+		t.Fatalf("expected %+v but got %+v", expected, c)
+	}
+
+	// flip a byte in the last chunk and cut the snapshot short
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)-10] ^= 1
+	for _, bad := range [][]byte{corrupt, b[:len(b)-1], b[:headerSize-1]} {
+		if _, err := ValidateSnapshot(bytes.NewReader(bad)); err == nil {
+			t.Fatalf("expected error for a corrupt snapshot")
+		}
+	}
+}
+
+func TestRunLengthChunk(t *testing.T) {
+	for _, bs := range []uint8{1, 4, 16} {
+		for _, n := range []int{0, 1, 100, 2000} {
+			f := newFilter(1<<12, bs, hasherPool(defaultHash))
+			for i := 0; i < n; i++ {
+				f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+			}
+
+			// the last bucket occupied and full ends the chunk without a trailing run
+			last := &f.buckets[len(f.buckets)-1]
+			for j := uint8(0); j < bs; j++ {
+				last.FPs[j], last.Track = uint16(j), set(last.Track, j)
+			}
+
+			b := encodeRunLengthChunk(f.buckets, bs)
+			if full := len(encodeChunk(f.buckets, bs)); n < 2000 && len(b) >= full {
+				t.Fatalf("expected %d items in buckets of %d to take less than %d bytes but got %d", n, bs, full, len(b))
+			}
+
+			buckets := initBuckets(f.totalBuckets, bs)
+			if err := decodeRunLengthChunk(b, buckets, bs); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(buckets, f.buckets) {
+				t.Fatalf("%d items in buckets of %d: buckets mismatch after round trip", n, bs)
+			}
+		}
+	}
+
+	buckets := make([]bucket, 4)
+	for i := range buckets {
+		buckets[i].FPs = make([]fingerprint, 2)
+	}
+
+	tests := []struct {
+		name string
+		runs []byte
+	}{
+		{"run past the chunk", []byte{5}},
+		{"empty occupied bucket", []byte{0, 0, 0}},
+		{"occupancy past the bucket", []byte{0, 0, 4}},
+		{"truncated fingerprint", []byte{0, 0, 1, 7}},
+		{"trailing bytes", []byte{4, 1}},
+		{"missing runs", nil},
+	}
+
+	for _, c := range tests {
+		b := binary.BigEndian.AppendUint32(nil, uint32(len(c.runs)))
+		b = append(b, c.runs...)
+		b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+		if err := decodeRunLengthChunk(b, buckets, 2); err == nil {
+			t.Fatalf("%s: expected error", c.name)
+		}
+	}
+}
+
+func Test_decodeChunk(t *testing.T) {
+	buckets := initBuckets(1, 2)
+	for _, c := range []struct {
+		track uint16
+		ok    bool
+	}{{0, true}, {3, true}, {4, false}, {0xffff, false}} {
+		b := binary.BigEndian.AppendUint16(nil, c.track)
+		b = binary.BigEndian.AppendUint16(b, 7)
+		b = binary.BigEndian.AppendUint16(b, 9)
+		b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+		if err := decodeChunk(b, buckets, 2); (err == nil) != c.ok {
+			t.Fatalf("occupancy %#x: expected ok %t but got %v", c.track, c.ok, err)
+		}
+	}
+}
+
+func Test_headerChunks(t *testing.T) {
+	tests := []struct {
+		totalBuckets, chunkBuckets uint32
+		chunks, last               uint32
+	}{
+		{1, chunkBuckets, 1, 1},
+		{chunkBuckets + 1, chunkBuckets, 2, 1},
+		{math.MaxUint32, math.MaxUint32, 1, math.MaxUint32},
+		{math.MaxUint32, 1 << 31, 2, 1<<31 - 1},
+	}
+
+	for _, c := range tests {
+		h := header{totalBuckets: c.totalBuckets, chunkBuckets: c.chunkBuckets}
+		if h.chunks() != c.chunks {
+			t.Fatalf("%d buckets in chunks of %d: expected %d chunks but got %d", c.totalBuckets, c.chunkBuckets, c.chunks, h.chunks())
+		}
+
+		if first, n, _ := h.chunk(c.chunks - 1); n != c.last || first+n != c.totalBuckets {
+			t.Fatalf("%d buckets in chunks of %d: expected a last chunk of %d but got %d from %d",
+				c.totalBuckets, c.chunkBuckets, c.last, n, first)
+		}
+	}
+}
+
+func TestReadFromParallel_runLength(t *testing.T) {
+	f := NewFilter(1 << 14)
+	for i := 0; i < 1000; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	b, err := appendBinary(f, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if b[5]&flagRunLength == 0 || int64(len(b)) >= headerSize+int64(f.totalBuckets)*headerOf(f).bucketBytes() {
+		t.Fatalf("expected a sparse filter to be run length encoded, got %d bytes", len(b))
+	}
+
+	df, err := ReadFromParallel(bytes.NewReader(b), 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if df.Count() != f.Count() || !reflect.DeepEqual(df.buckets, f.buckets) {
+		t.Fatalf("filter mismatch after round trip")
+	}
+
+	if _, err := ReadFromParallel(bytes.NewReader(b[:len(b)-1]), 4); err == nil {
+		t.Fatalf("expected error reading a truncated filter")
+	}
+}
+
+func TestWithStrictLoad(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for i := 0; i < 100; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	// a count out of step with the buckets, as a tampered snapshot has
+	f.count.Store(1000)
+	b, err := appendBinary(f, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var gb bytes.Buffer
+	if err := f.Encode(&gb); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	loads := []struct {
+		name string
+		load func(opts ...LoadOption) (*Filter, error)
+	}{
+		{name: "binary", load: func(opts ...LoadOption) (*Filter, error) {
+			return ReadFromParallel(bytes.NewReader(b), 2, opts...)
+		}},
+		{name: "gob", load: func(opts ...LoadOption) (*Filter, error) {
+			return Decode(bytes.NewReader(gb.Bytes()), opts...)
+		}},
+	}
+
+	for _, c := range loads {
+		df, err := c.load()
+		if err != nil || df.Count() != 100 {
+			t.Fatalf("%s: expected the count corrected to 100: %v", c.name, err)
+		}
+
+		if _, err := c.load(WithStrictLoad()); !errors.Is(err, ErrCountMismatch) {
+			t.Fatalf("%s: expected %v but got %v", c.name, ErrCountMismatch, err)
+		}
+	}
+
+	f.count.Store(100)
+	b, _ = appendBinary(f, nil)
+	if df, err := ReadFromParallel(bytes.NewReader(b), 2, WithStrictLoad()); err != nil || df.Count() != 100 {
+		t.Fatalf("expected a strict load of a matching count: %v", err)
+	}
+}
+
+func TestFilter_MarshalBinary(t *testing.T) {
+	full, err := NewWithOptions(WithCapacity(1<<10), WithSeed(7))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; full.Insert([]byte(fmt.Sprintf("item-%d", i))); i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	tests := []struct {
+		name  string
+		f     *Filter
+		items [][]byte
+	}{
+		{name: "empty", f: NewFilter(1 << 10)},
+		{name: "full", f: full, items: items},
+	}
+
+	for _, c := range tests {
+		b, err := c.f.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		df := new(Filter)
+		if err := df.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		if df.Count() != c.f.Count() || df.UConfig() != c.f.UConfig() || !reflect.DeepEqual(df.buckets, c.f.buckets) {
+			t.Fatalf("%s: filter mismatch after round trip", c.name)
+		}
+
+		for _, x := range c.items {
+			if !df.Lookup(x) {
+				t.Fatalf("%s: lookup failed: %s", c.name, x)
+			}
+		}
+
+		// a header claiming more buckets than the data holds, or a shorter one
+		for _, n := range []int{0, 4, headerSize - 1, headerSize, len(b) / 2, len(b) - 1} {
+			if err := df.UnmarshalBinary(b[:n]); err == nil {
+				t.Fatalf("%s: expected error for %d of %d bytes", c.name, n, len(b))
+			}
+		}
+
+		b[6]++
+		if err := df.UnmarshalBinary(b); err == nil {
+			t.Fatalf("%s: expected error for a changed bucket size", c.name)
+		}
+
+		if df.Count() != c.f.Count() {
+			t.Fatalf("%s: expected a failed unmarshal to leave the filter as it was", c.name)
+		}
+	}
+
+	// a header alone claiming a huge table fails before allocating it
+	for _, flags := range []uint8{0, flagRunLength} {
+		h := header{flags: flags, bucketSize: 16, fpBits: fingerprintBits, totalBuckets: 1 << 31, chunkBuckets: chunkBuckets, seed: seed}
+		err := new(Filter).UnmarshalBinary(h.encode())
+		if err == nil || !strings.Contains(err.Error(), "need at least") {
+			t.Fatalf("expected a size error for flags %#x but got %v", flags, err)
+		}
+	}
+
+	// the header records the fingerprint width, and other widths aren't read
+	h := headerOf(NewFilter(1 << 10))
+	if h.config().FingerprintBits != fingerprintBits {
+		t.Fatalf("expected %d-bit fingerprints but got %d", fingerprintBits, h.config().FingerprintBits)
+	}
+
+	for _, bits := range []uint8{0, 8, 32} {
+		h.fpBits = bits
+		err := new(Filter).UnmarshalBinary(h.encode())
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("%d-bit", bits)) {
+			t.Fatalf("expected a width error for %d bits but got %v", bits, err)
+		}
+	}
+
+	// version 1 headers aren't read any more
+	b := headerOf(NewFilter(1 << 10)).encode()
+	b[4] = 1
+	binary.BigEndian.PutUint32(b[28:], crc32.ChecksumIEEE(b[:28]))
+	if err := new(Filter).UnmarshalBinary(b); err == nil || !strings.Contains(err.Error(), "version 1") {
+		t.Fatalf("expected a version error but got %v", err)
+	}
+}
+
+func TestFilter_UnmarshalBinaryKeepsOptions(t *testing.T) {
+	src, _ := NewWithOptions(WithCapacity(1000), WithKeyTransform(bytes.ToLower))
+	for i := 0; i < 500; i++ {
+		src.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	b, err := src.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var evicted int
+	f, _ := NewWithOptions(WithCapacity(60), WithKeyTransform(bytes.ToLower), WithMaxKeySize(16),
+		WithDeleteSafety(), WithOverflowBloom(1000), WithEvictionHook(func(uint32, Fingerprint) { evicted++ }))
+	for i := 0; i < 200; i++ {
+		f.Insert([]byte(fmt.Sprintf("old-%d", i)))
+	}
+
+	if err := f.UnmarshalBinary(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f.Count() != src.Count() || !reflect.DeepEqual(f.buckets, src.buckets) {
+		t.Fatalf("expected the contents of the snapshot")
+	}
+
+	// keys are still transformed and bounded
+	for i := 0; i < 500; i++ {
+		if x := []byte(fmt.Sprintf("ITEM-%d", i)); !f.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	if err := f.InsertWithError([]byte("an item past sixteen bytes")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected %v but got %v", ErrKeyTooLarge, err)
+	}
+
+	// the spilled items and references were for the replaced contents
+	if f.Lookup([]byte("old-199")) || f.refs == nil || len(f.refs) != 0 {
+		t.Fatalf("expected the overflow and references of the old contents to be dropped")
+	}
+
+	evicted = 0
+	for i := 0; i < 450; i++ {
+		f.Insert([]byte(fmt.Sprintf("new-%d", i)))
+	}
+
+	if evicted == 0 {
+		t.Fatalf("expected the eviction hook to be kept")
+	}
+}
+
+func TestFilter_WriteToReadFrom(t *testing.T) {
+	for _, n := range []int{1000, 20000} {
+		f := NewFilter(64000)
+		for i := 0; i < n; i++ {
+			f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+		}
+
+		var buf bytes.Buffer
+		written, err := f.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("%d items: unexpected error: %v", n, err)
+		}
+
+		b, _ := f.MarshalBinary()
+		if written != int64(buf.Len()) || !bytes.Equal(buf.Bytes(), b) {
+			t.Fatalf("%d items: expected %d bytes as MarshalBinary writes but got %d", n, len(b), written)
+		}
+
+		// short reads are read through
+		df, err := ReadFrom(iotest.OneByteReader(bytes.NewReader(b)))
+		if err != nil {
+			t.Fatalf("%d items: unexpected error: %v", n, err)
+		}
+
+		if df.Count() != f.Count() || !reflect.DeepEqual(df.buckets, f.buckets) {
+			t.Fatalf("%d items: filter mismatch after round trip", n)
+		}
+
+		// a truncated stream reports the buckets read before the missing chunk
+		_, err = ReadFrom(bytes.NewReader(b[:len(b)-1]))
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("after %d buckets", chunkBuckets)) {
+			t.Fatalf("%d items: expected error after %d buckets but got %v", n, chunkBuckets, err)
+		}
+	}
+
+	// a header alone claiming a huge table fails having allocated no buckets
+	h := header{bucketSize: 16, fpBits: fingerprintBits, totalBuckets: 1 << 31, chunkBuckets: chunkBuckets, seed: seed}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := ReadFrom(bytes.NewReader(h.encode()))
+	runtime.ReadMemStats(&after)
+	if err == nil || !strings.Contains(err.Error(), "after 0 buckets") {
+		t.Fatalf("expected error after 0 buckets but got %v", err)
+	}
+
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("expected a header alone to allocate little but it allocated %d bytes", n)
+	}
+}
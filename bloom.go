@@ -0,0 +1,62 @@
+package cuckoo
+
+import (
+	"math"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// bloomFPR is the false positive rate an overflow bloom filter is sized for
+const bloomFPR = 0.01
+
+// bloomFilter holds the items that didn't fit in a Filter
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint8
+}
+
+// newBloomFilter returns a bloom filter sized for capacity items at bloomFPR
+func newBloomFilter(capacity uint32) *bloomFilter {
+	n := float64(capacity)
+	m := optimalBloomBits(n, bloomFPR)
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint8(k),
+	}
+}
+
+// optimalBloomBits returns the bits an optimal bloom filter needs to hold n items
+// at false positive rate p, -n ln(p) / ln(2)^2
+func optimalBloomBits(n, p float64) float64 {
+	return math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2))
+}
+
+// bitsOf calls fn with each bit of x using double hashing
+func (b *bloomFilter) bitsOf(x []byte, fn func(word int, mask uint64) bool) bool {
+	h1, h2 := murmur3.Sum128WithSeed(x, seed)
+	m := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		bit := (h1 + i*h2) % m
+		if !fn(int(bit/64), 1<<(bit%64)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// add sets the bits of x
+func (b *bloomFilter) add(x []byte) {
+	b.bitsOf(x, func(word int, mask uint64) bool {
+		b.bits[word] |= mask
+		return true
+	})
+}
+
+// contains returns true if all the bits of x are set
+func (b *bloomFilter) contains(x []byte) bool {
+	return b.bitsOf(x, func(word int, mask uint64) bool {
+		return b.bits[word]&mask != 0
+	})
+}
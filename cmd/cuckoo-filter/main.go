@@ -62,7 +62,7 @@ func main() {
 	fmt.Printf("Time Taken: %s\n", tt)
 	fmt.Println("=================")
 
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	for range ch {
 		return
@@ -0,0 +1,91 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Config is the configuration a filter places and hashes its items with
+type Config struct {
+	BucketSize      uint8
+	TotalBuckets    uint32
+	MaxKicks        uint16
+	Seed            uint32
+	FingerprintBits uint8
+	ByteOrder       binary.ByteOrder
+	Indexing        IndexingScheme
+	LengthPrefix    bool
+	StrictKeys      bool
+}
+
+// Config returns the configuration of the filter, for logging and for
+// NewFilterFromConfig
+func (f *Filter) Config() Config {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UConfig()
+}
+
+// UConfig returns the configuration of the filter. Not thread safe
+func (f *Filter) UConfig() Config {
+	return Config{
+		BucketSize:      f.bucketSize,
+		TotalBuckets:    f.totalBuckets,
+		MaxKicks:        f.maxKicks,
+		Seed:            f.seed,
+		FingerprintBits: fingerprintBits,
+		ByteOrder:       f.order,
+		Indexing:        f.indexing,
+		LengthPrefix:    f.lengthPrefix,
+		StrictKeys:      f.strictKeys,
+	}
+}
+
+// NewFilterFromConfig returns an empty filter configured by c, which places
+// and hashes items like the filter c was taken from
+func NewFilterFromConfig(c Config) (*Filter, error) {
+	if err := validateConfig(c); err != nil {
+		return nil, err
+	}
+
+	return filterFromConfig(c, initBuckets(c.TotalBuckets, c.BucketSize)), nil
+}
+
+// validateConfig returns an error if c can't configure a filter
+func validateConfig(c Config) error {
+	if c.BucketSize == 0 || c.BucketSize > maxBucketSize {
+		return fmt.Errorf("doesn't support %d bucket size. Max bucket size is %d", c.BucketSize, maxBucketSize)
+	}
+
+	if !isPowerOf2(c.TotalBuckets) {
+		return fmt.Errorf("total buckets %d must be a power of 2", c.TotalBuckets)
+	}
+
+	if c.FingerprintBits != fingerprintBits {
+		return fmt.Errorf("doesn't support %d-bit fingerprints, only %d-bit", c.FingerprintBits, fingerprintBits)
+	}
+
+	if c.ByteOrder != binary.BigEndian && c.ByteOrder != binary.LittleEndian {
+		return fmt.Errorf("byte order must be big or little endian")
+	}
+
+	if c.Indexing > AltSeedIndexing {
+		return fmt.Errorf("unknown indexing scheme %d", c.Indexing)
+	}
+
+	return nil
+}
+
+// filterFromConfig returns a filter configured by the valid c over buckets,
+// c.TotalBuckets of them of size c.BucketSize
+func filterFromConfig(c Config, buckets []bucket) *Filter {
+	f := newFilterOver(buckets, c.BucketSize, hasherPool(murmurHash(c.Seed)))
+	f.seed = c.Seed
+	f.maxKicks = c.MaxKicks
+	f.order = c.ByteOrder
+	f.indexing = c.Indexing
+	f.lengthPrefix = c.LengthPrefix
+	f.strictKeys = c.StrictKeys
+	return f
+}
@@ -0,0 +1,48 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestNewFilterFromConfig(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithSeed(7), WithByteOrder(binary.LittleEndian),
+		WithIndexing(PartialKeyIndexing), WithStrictKeys())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.Insert([]byte("hello"))
+	nf, err := NewFilterFromConfig(f.Config())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if nf.Config() != f.Config() || !nf.CompatibleWith(f) || nf.Count() != 0 {
+		t.Fatalf("expected an empty filter configured like %+v but got %+v", f.Config(), nf.Config())
+	}
+
+	nf.Insert([]byte("hello"))
+	if nf.StateHash() != f.StateHash() {
+		t.Fatalf("expected the item stored the same way")
+	}
+
+	valid := f.Config()
+	tests := []func(c *Config){
+		func(c *Config) { c.BucketSize = 0 },
+		func(c *Config) { c.BucketSize = maxBucketSize + 1 },
+		func(c *Config) { c.TotalBuckets = 0 },
+		func(c *Config) { c.TotalBuckets = 1000 },
+		func(c *Config) { c.FingerprintBits = 8 },
+		func(c *Config) { c.ByteOrder = nil },
+		func(c *Config) { c.Indexing = AltSeedIndexing + 1 },
+	}
+
+	for i, mutate := range tests {
+		c := valid
+		mutate(&c)
+		if _, err := NewFilterFromConfig(c); err == nil {
+			t.Fatalf("%d: expected error for %+v", i, c)
+		}
+	}
+}
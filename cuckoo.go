@@ -3,11 +3,19 @@ package cuckoo
 import (
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"hash"
+	"hash/fnv"
 	"io"
+	"math"
+	"math/bits"
 	"math/rand"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/spaolacci/murmur3"
 )
@@ -18,40 +26,201 @@ const (
 	defaultTotalBuckets = 4 << 20
 	defaultMaxKicks     = 500
 	seed                = 59053
+
+	// sparseLoadFactor is the load below which Encode writes only occupied slots
+	sparseLoadFactor = 0.25
+
+	// kicksPerTimeCheck is how often the kick loop checks the kick timeout
+	kicksPerTimeCheck = 16
+)
+
+var (
+	// ErrCapacityTooTight is returned when holding the requested item count
+	// within the estimated load factor would take more slots than a filter can have
+	ErrCapacityTooTight = errors.New("requested items exceed the safe load of the filter")
+
+	// ErrFilterFull is returned when an item can't be placed in the filter
+	ErrFilterFull = errors.New("filter is full")
+
+	// ErrTimeout is returned when an insert kicks for longer than the kick timeout
+	ErrTimeout = errors.New("insert timed out")
+
+	// ErrInvalidInput is returned for items the filter can't hold, like empty ones
+	ErrInvalidInput = errors.New("invalid item")
+
+	// ErrMaxMultiplicity is returned when both buckets of an item are full of
+	// its own fingerprint, so no amount of kicking can place another copy
+	ErrMaxMultiplicity = errors.New("item is at max multiplicity")
+
+	// ErrClosed is returned when the filter is used after Close
+	ErrClosed = errors.New("filter is closed")
+
+	// ErrSoftCapReached is returned for inserts into a filter loaded up to its soft cap
+	ErrSoftCapReached = errors.New("filter is at its soft cap")
+
+	// ErrCountMismatch is returned by a strict load of a filter whose stored
+	// count doesn't match the fingerprints it holds
+	ErrCountMismatch = errors.New("count doesn't match the stored fingerprints")
+
+	// ErrHashMismatch is returned when loading a filter with another hash
+	// than it was stored with, see WithLoadHash
+	ErrHashMismatch = errors.New("filter was stored with another hash")
 )
 
-// fingerprint of the item
-type fingerprint uint16
+// fingerprint of the item, as the buckets store it
+type fingerprint = uint16
+
+// Fingerprint is a stored fingerprint as the API passes it. It's wider than
+// the 16 bits filters store, so other fingerprint widths can be stored
+// without changing the signatures taking or returning fingerprints
+type Fingerprint uint32
 
 // emptyFingerprint
 var emptyFingerprint fingerprint
 
 // bucket with n fingerprints
 type bucket struct {
+	// Track is the occupancy bitmap of the slots, bit i set when FPs[i] holds a
+	// fingerprint. Emptiness never depends on the fingerprint value, so every
+	// 16 bit fingerprint including 0 can be stored
 	Track uint16
 	FPs   []fingerprint
 }
 
-// Filter is the cuckoo-filter
+// Filter is the cuckoo-filter. Items passed to it are only read during the
+// call, never retained or modified, so their buffers can be reused as soon as
+// a call returns
 type Filter struct {
-	count        uint32
+	// count is updated under the write lock but read atomically
+	count atomic.Uint32
+	// geometry is the bucket size and count packed by setGeometry, so
+	// LoadFactor can read them atomically too
+	geometry     atomic.Uint64
 	buckets      []bucket
 	bucketSize   uint8
 	totalBuckets uint32
-	hash         hash.Hash32
-	maxKicks     uint16
+	// mask is bucketMask(totalBuckets), so indices of a power of 2 bucket
+	// count are masked instead of divided
+	mask uint32
+	// hashers hands every hashing call a hasher of its own, so concurrent
+	// lookups never share hash state and only need the read lock
+	hashers *sync.Pool
+	// hashID tells the hash of the hashers apart from others, see hashIDOf.
+	// customHash is set when it's a WithHash hash rather than murmur3
+	hashID        uint32
+	customHash    bool
+	seed          uint32
+	maxKicks      uint16
+	kickStep      uint16
+	kickLimit     uint16
+	victim        VictimStrategy
+	kickStart     KickStartMode
+	deterministic bool
+	evictHook     func(bucket uint32, fp Fingerprint)
+	transform     func([]byte) []byte
+	lengthPrefix  bool
+	strictKeys    bool
+	order         binary.ByteOrder
+	indexing      IndexingScheme
+	overflow      *bloomFilter
+	kickTimeout   time.Duration
+	softCap       float64
+	readLimit     int64
+	maxKeySize    int
+	hashOps       *atomic.Uint64
+	rnd           *rand.Rand
+	refs          map[refKey]uint32
+	closed        bool
+
+	// path of the current insert's kicks, reused across inserts
+	path  []kick
+	stats filterStats
+
+	// victimFPs passes a full bucket to the victim strategy, reused across kicks
+	victimFPs []Fingerprint
+
+	// pool is the Pool that built the filter, the only one it's put back into
+	pool *Pool
 
 	// protects above fields
 	L sync.RWMutex
 }
 
+// gobVersion is the version of gobFilter. Version 0 predates the seed and
+// version 1 the hash id
+const gobVersion = 2
+
 // gobFilter for encoding and decoding the Filter
 type gobFilter struct {
+	Version      uint8
+	Seed         uint32
 	Count        uint32
 	Buckets      []bucket
 	BucketSize   uint8
 	TotalBuckets uint32
 	MaxKicks     uint16
+
+	// Sparse is set when Buckets is empty and only occupied slots are in Entries
+	Sparse  bool
+	Entries []sparseEntry
+
+	// Overflow holds the bits of the overflow bloom filter, if any
+	Overflow       []uint64
+	OverflowHashes uint8
+
+	// LengthPrefix is set when keys are hashed with their length prefixed
+	LengthPrefix bool
+
+	// LittleEndian is set when fingerprints are read little endian
+	LittleEndian bool
+
+	// Indexing is the scheme alternate buckets are found with
+	Indexing IndexingScheme
+
+	// StrictKeys is set when keys are hashed without padding
+	StrictKeys bool
+
+	// CustomHash is set for filters hashing with a WithHash hash, whose
+	// hashIDOf is HashID
+	CustomHash bool
+	HashID     uint32
+}
+
+// sparseEntry is an occupied slot in a sparse encoded filter
+type sparseEntry struct {
+	Index uint32
+	Slot  uint8
+	FP    fingerprint
+}
+
+// sparseEntries returns all the occupied slots of the buckets
+func sparseEntries(buckets []bucket, bs uint8) []sparseEntry {
+	var entries []sparseEntry
+	for i, b := range buckets {
+		for j := uint8(0); j < bs; j++ {
+			if isSet(b.Track, j) {
+				entries = append(entries, sparseEntry{Index: uint32(i), Slot: j, FP: b.FPs[j]})
+			}
+		}
+	}
+
+	return entries
+}
+
+// bucketsFromEntries rebuilds the buckets from the sparse entries
+func bucketsFromEntries(entries []sparseEntry, tb uint32, bs uint8) ([]bucket, error) {
+	buckets := initBuckets(tb, bs)
+	for _, e := range entries {
+		if e.Index >= tb || e.Slot >= bs {
+			return nil, fmt.Errorf("slot %d of bucket %d out of range", e.Slot, e.Index)
+		}
+
+		b := &buckets[e.Index]
+		b.FPs[e.Slot] = e.FP
+		b.Track = set(b.Track, e.Slot)
+	}
+
+	return buckets, nil
 }
 
 // initBuckets initialises the buckets
@@ -64,46 +233,242 @@ func initBuckets(totalBuckets uint32, bucketSize uint8) []bucket {
 	return buckets
 }
 
-// StdFilter returns Standard Cuckoo-Filter
+// StdFilter returns Standard Cuckoo-Filter, NewWithOptions without options
 func StdFilter() *Filter {
-	return newFilter(defaultTotalBuckets, defaultBucketSize, murmur3.New32WithSeed(seed))
+	// the default options always build
+	f, _ := NewWithOptions()
+	return f
+}
+
+// defaultHash returns the hash filters use by default
+func defaultHash() hash.Hash32 {
+	return murmur3.New32WithSeed(seed)
+}
+
+// murmurHash returns a func returning the default hash with seed s
+func murmurHash(s uint32) func() hash.Hash32 {
+	return func() hash.Hash32 {
+		return murmur3.New32WithSeed(s)
+	}
+}
+
+// hasherPool returns a pool of the hashers returned by newHash
+func hasherPool(newHash func() hash.Hash32) *sync.Pool {
+	return &sync.Pool{New: func() any { return &hasher{Hash32: newHash()} }}
+}
+
+// hashProbe is the input hashIDOf hashes
+var hashProbe = []byte("cuckoo filter hash probe")
+
+// hashIDOf returns the hash of hashProbe by the pooled hashers. Different
+// hashes, or seeds of one hash, give different ids with high probability
+func hashIDOf(hashers *sync.Pool) uint32 {
+	h := hashers.Get().(*hasher)
+	defer hashers.Put(h)
+
+	return hashOf(hashProbe, h)
+}
+
+func newFilter(tb uint32, bs uint8, hashers *sync.Pool) *Filter {
+	return newFilterOver(initBuckets(tb, bs), bs, hashers)
 }
 
-func newFilter(tb uint32, bs uint8, hash hash.Hash32) *Filter {
-	return &Filter{
-		buckets:      initBuckets(tb, bs),
+// newFilterOver returns a filter over buckets of size bs
+func newFilterOver(buckets []bucket, bs uint8, hashers *sync.Pool) *Filter {
+	tb := uint32(len(buckets))
+	f := &Filter{
+		buckets:      buckets,
 		bucketSize:   bs,
 		totalBuckets: tb,
-		hash:         hash,
+		mask:         bucketMask(tb),
+		hashers:      hashers,
+		hashID:       hashIDOf(hashers),
+		seed:         seed,
 		maxKicks:     defaultMaxKicks,
+		order:        binary.BigEndian,
+	}
+
+	setGeometry(f)
+	return f
+}
+
+// setGeometry publishes the bucket size and count of f for the reads that
+// don't take the lock. Not thread safe
+func setGeometry(f *Filter) {
+	f.geometry.Store(uint64(f.bucketSize)<<32 | uint64(f.totalBuckets))
+}
+
+// loadGeometry returns the bucket size and count of f without the lock
+func loadGeometry(f *Filter) (bs uint8, tb uint32) {
+	g := f.geometry.Load()
+	return uint8(g >> 32), uint32(g)
+}
+
+// newFilterLike returns an empty filter of tb buckets of size bs configured
+// like f. The victim strategy and eviction hook can keep state that assumes
+// the write lock of f, like RoundRobinVictim's position, so they aren't
+// shared and nf kicks at random without a hook
+func newFilterLike(f *Filter, tb uint32, bs uint8) *Filter {
+	// hashers are reset before every use, so filters can share a pool
+	nf := newFilter(tb, bs, f.hashers)
+	nf.customHash = f.customHash
+	nf.seed = f.seed
+	nf.maxKicks = f.maxKicks
+	nf.kickStep = f.kickStep
+	nf.kickLimit = f.kickLimit
+	nf.kickStart = f.kickStart
+	nf.deterministic = f.deterministic
+	nf.transform = f.transform
+	nf.lengthPrefix = f.lengthPrefix
+	nf.strictKeys = f.strictKeys
+	nf.order = f.order
+	nf.indexing = f.indexing
+	nf.kickTimeout = f.kickTimeout
+	nf.softCap = f.softCap
+	nf.readLimit = f.readLimit
+	nf.maxKeySize = f.maxKeySize
+	if f.hashOps != nil {
+		nf.hashOps = new(atomic.Uint64)
+	}
+	nf.rnd = f.rnd
+	if f.refs != nil {
+		nf.refs = make(map[refKey]uint32)
+	}
+	if f.stats.recent != nil {
+		nf.stats.recent = newFailureWindow(len(f.stats.recent.failed))
+	}
+	if f.overflow != nil {
+		nf.overflow = &bloomFilter{bits: append([]uint64(nil), f.overflow.bits...), hashes: f.overflow.hashes}
+	}
+
+	return nf
+}
+
+// bucketsFor returns the power of 2 buckets of size bs holding count items
+// within the estimated load factor, at least one so tiny counts still make a
+// usable filter. A count filling a power of 2 of slots past that load takes
+// the next one. Returns ErrCapacityTooTight if no filter has the slots
+func bucketsFor(count uint32, bs uint8) (uint32, error) {
+	slots, err := slotsFor(count, bs)
+	if err != nil {
+		return 0, err
 	}
+
+	return max(1, nextPowerOf2(slots)/uint32(bs)), nil
+}
+
+// safeItems returns the most items slots slots in buckets of size bs hold
+// within the estimated load factor
+func safeItems(slots uint64, bs uint8) uint32 {
+	return uint32(math.Floor(estimatedLoadFactor(bs) * float64(slots)))
 }
 
+// NewFilter returns a filter sized for count items, NewWithOptions with
+// WithCapacity. Counts past the most a filter holds get the largest filter,
+// and a count of 0 gets the filter of a single item
 func NewFilter(count uint32) *Filter {
-	b := nextPowerOf2(count) / defaultBucketSize
-	return newFilter(b, defaultBucketSize, murmur3.New32WithSeed(seed))
+	// clamped into what WithCapacity takes, so it always builds
+	f, _ := NewWithOptions(WithCapacity(max(1, min(count, safeItems(maxSlots, defaultBucketSize)))))
+	return f
 }
 
+// NewFilterWithBucketSize returns a filter of buckets of size bs sized for
+// count items, NewWithOptions with WithCapacity and WithBucketSize. A count
+// of 0 gets the filter of a single item. Returns ErrCapacityTooTight if no
+// filter holds count items within the estimated load factor
 func NewFilterWithBucketSize(count uint32, bs uint8) (*Filter, error) {
-	if bs > maxBucketSize {
-		return nil, fmt.Errorf("doesn't support %d bucket size. Max bucket size is %d", bs, maxBucketSize)
+	return NewWithOptions(WithCapacity(max(1, count)), WithBucketSize(bs))
+}
+
+// NewFilterFromBuckets returns a filter backed by data, a flat slice of
+// totalBuckets buckets of bucketSize fingerprints each. The filter reads and writes
+// data in place, so the caller controls its allocation. occupancy holds the
+// occupancy bitmap of every bucket, bit i set when slot i of the bucket holds a
+// fingerprint, so every fingerprint including 0 loads. It's copied, not written
+// in place, and Occupancy returns it to rebuild the filter later
+func NewFilterFromBuckets(data []uint16, occupancy []uint16, bucketSize uint8, totalBuckets uint32) (*Filter, error) {
+	if bucketSize == 0 || bucketSize > maxBucketSize {
+		return nil, fmt.Errorf("doesn't support %d bucket size. Max bucket size is %d", bucketSize, maxBucketSize)
 	}
 
-	b := nextPowerOf2(count) / uint32(bs)
-	return newFilter(b, bs, murmur3.New32WithSeed(seed)), nil
-}
+	if !isPowerOf2(totalBuckets) {
+		return nil, fmt.Errorf("total buckets %d must be a power of 2", totalBuckets)
+	}
 
-// nextPowerOf2 returns the next power 2 >= v
-func nextPowerOf2(v uint32) (n uint32) {
-	var i uint32
-	for i = 2; i < 32; i++ {
-		n = 1 << i
-		if n >= v {
-			break
+	if uint64(len(data)) != uint64(bucketSize)*uint64(totalBuckets) {
+		return nil, fmt.Errorf("expected %d fingerprints but got %d", uint64(bucketSize)*uint64(totalBuckets), len(data))
+	}
+
+	if uint64(len(occupancy)) != uint64(totalBuckets) {
+		return nil, fmt.Errorf("expected the occupancy of %d buckets but got %d", totalBuckets, len(occupancy))
+	}
+
+	f := newFilterOver(make([]bucket, totalBuckets), bucketSize, hasherPool(defaultHash))
+	var count uint32
+	bs := int(bucketSize)
+	for i := range f.buckets {
+		track := occupancy[i]
+		if bucketSize < 16 && track>>bucketSize != 0 {
+			return nil, fmt.Errorf("invalid occupancy %#x of bucket %d", track, i)
 		}
+
+		b := &f.buckets[i]
+		b.FPs = data[i*bs : (i+1)*bs : (i+1)*bs]
+		b.Track = track
+		count += uint32(bits.OnesCount16(track))
 	}
 
-	return n
+	f.count.Store(count)
+	return f, nil
+}
+
+// Occupancy returns the occupancy bitmap of every bucket, bit i set when slot
+// i of the bucket holds a fingerprint, as NewFilterFromBuckets takes it
+func (f *Filter) Occupancy() []uint16 {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UOccupancy()
+}
+
+// UOccupancy returns the occupancy bitmap of every bucket. Not thread safe
+func (f *Filter) UOccupancy() []uint16 {
+	occupancy := make([]uint16, len(f.buckets))
+	for i, b := range f.buckets {
+		occupancy[i] = b.Track
+	}
+
+	return occupancy
+}
+
+// maxSlots is the most slots bucketsFor sizes a filter to
+const maxSlots = 1 << 31
+
+// slotsFor returns the slots holding count items in buckets of size bs within
+// their estimated load factor. Returns ErrCapacityTooTight if that's more
+// slots than a filter can have
+func slotsFor(count uint32, bs uint8) (uint32, error) {
+	slots := math.Ceil(float64(count) / estimatedLoadFactor(bs))
+	if slots > maxSlots {
+		return 0, fmt.Errorf("%d items need %.0f slots: %w", count, slots, ErrCapacityTooTight)
+	}
+
+	return uint32(slots), nil
+}
+
+// nextPowerOf2 returns the next power 2 >= v, 1 for 0. Past 1<<31 there's no
+// uint32 power of 2 left, so it saturates at 1<<31
+func nextPowerOf2(v uint32) uint32 {
+	if v > 1<<31 {
+		return 1 << 31
+	}
+
+	return 1 << bits.Len32(max(v, 1)-1)
+}
+
+// isPowerOf2 returns true if v is a power of 2
+func isPowerOf2(v uint32) bool {
+	return v != 0 && v&(v-1) == 0
 }
 
 // isSet returns true if the i th bit in the Track is 1
@@ -161,36 +526,88 @@ func addToBucket(b *bucket, bs uint8, fp fingerprint) bool {
 	return false
 }
 
-// hashOf returns the 32-bit hash
-func hashOf(x []byte, hash hash.Hash32) (uint32, []byte) {
-	hash.Reset()
-	hash.Write(x)
-	h := hash.Sum32()
-	return h, hash.Sum(nil)
+// hasher is a pooled hash with scratch space for the bytes fed to it besides
+// the item, so hashing doesn't allocate
+type hasher struct {
+	hash.Hash32
+	buf [binary.MaxVarintLen64]byte
 }
 
-// fingerprintOf returns the fingerprint of x with size using hash
-func fingerprintOf(xb []byte) (fp fingerprint) {
-	return fingerprint(binary.BigEndian.Uint16(xb))
+// zeroPad is fed before single byte items, see sanitize
+var zeroPad = []byte{0}
+
+// hashOf returns the 32-bit hash of x
+func hashOf(x []byte, h hash.Hash32) uint32 {
+	h.Reset()
+	h.Write(x)
+	return h.Sum32()
 }
 
-func fingerprintHash(fp fingerprint, hash hash.Hash32) (fph uint32) {
-	b := make([]byte, 2, 2)
-	binary.BigEndian.PutUint16(b, uint16(fp))
-	fph, _ = hashOf(b, hash)
-	return fph
+// keyHash returns the hash of item x keyed the way keyBytes does, without
+// building the key
+func keyHash(f *Filter, x []byte, h *hasher) uint32 {
+	h.Reset()
+	switch {
+	case f.lengthPrefix:
+		h.Write(binary.AppendUvarint(h.buf[:0], uint64(len(x))))
+	case len(x) == 1 && !f.strictKeys:
+		h.Write(zeroPad)
+	}
+
+	h.Write(x)
+	return h.Sum32()
+}
+
+// fingerprintOf returns the fingerprint in the hash xb of an item, read in order
+func fingerprintOf(xb []byte, order binary.ByteOrder) (fp fingerprint) {
+	return fingerprint(order.Uint16(xb))
+}
+
+// fingerprintHash returns the hash of fp written in order
+func fingerprintHash(fp fingerprint, h *hasher, order binary.ByteOrder) (fph uint32) {
+	order.PutUint16(h.buf[:2], uint16(fp))
+	return hashOf(h.buf[:2], h)
+}
+
+// bucketMask returns the mask taking hashes modulo totalBuckets if it's a
+// power of 2, or 0 if they must be taken modulo with a division
+func bucketMask(totalBuckets uint32) uint32 {
+	if totalBuckets < 2 || !isPowerOf2(totalBuckets) {
+		return 0
+	}
+
+	return totalBuckets - 1
+}
+
+// modBuckets returns v modulo totalBuckets, masking it if mask is set
+func modBuckets(v, totalBuckets, mask uint32) uint32 {
+	if mask != 0 {
+		return v & mask
+	}
+
+	return v % totalBuckets
 }
 
 // indicesOf returns the indices of item x using given hash
-func indicesOf(xh, fph, totalBuckets uint32) (i1, i2 uint32) {
-	i1 = xh % totalBuckets
-	i2 = alternateIndex(totalBuckets, i1, fph)
+func indicesOf(scheme IndexingScheme, xh, fph, totalBuckets, mask uint32) (i1, i2 uint32) {
+	i1 = modBuckets(xh, totalBuckets, mask)
+	i2 = alternateIndex(scheme, totalBuckets, mask, i1, fph)
 	return i1, i2
 }
 
-// alternateIndex returns the alternate index of i
-func alternateIndex(totalBuckets, i, fph uint32) (j uint32) {
-	return (i ^ fph) % totalBuckets
+// alternateIndex returns the alternate index of i under the scheme
+func alternateIndex(scheme IndexingScheme, totalBuckets, mask, i, fph uint32) (j uint32) {
+	if scheme == PartialKeyIndexing {
+		// i < totalBuckets, so neither branch can wrap
+		h := modBuckets(fph, totalBuckets, mask)
+		if h >= i {
+			return h - i
+		}
+
+		return totalBuckets - (i - h)
+	}
+
+	return modBuckets(i^fph, totalBuckets, mask)
 }
 
 // estimatedLoadFactor returns an estimated max load factor based on bucket size
@@ -216,220 +633,1252 @@ func isReliable(f *Filter) bool {
 	return false
 }
 
-// swapFingerprint swaps a random fp from the bucket with provided fp
-func swapFingerprint(b *bucket, fp fingerprint) fingerprint {
-	var sfp fingerprint
-	k := rand.Intn(len(b.FPs))
-	sfp, b.FPs[k] = b.FPs[k], fp
-	return sfp
+// lockedSource makes a rand.Source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
 }
 
-// insert inserts the item into filter
-func insert(f *Filter, x []byte) (ok bool) {
-	xh, xb := hashOf(x, f.hash)
-	fp := fingerprintOf(xb)
-	fph := fingerprintHash(fp, f.hash)
-	i1, i2 := indicesOf(xh, fph, f.totalBuckets)
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
 
-	defer func() {
-		if ok {
-			f.count++
-		}
-	}()
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
 
-	if addToBucket(&f.buckets[i1], f.bucketSize, fp) || addToBucket(&f.buckets[i2], f.bucketSize, fp) {
-		return true
+// intn returns a random int in [0, n) from the rand source of the filter
+func intn(f *Filter, n int) int {
+	if f.rnd == nil {
+		return rand.Intn(n)
 	}
 
-	ri := []uint32{i1, i2}[rand.Intn(2)]
-	var k uint16
-	for k = 0; k < f.maxKicks; k++ {
-		fp = swapFingerprint(&f.buckets[ri], fp)
-		fph = fingerprintHash(fp, f.hash)
-		ri = alternateIndex(f.totalBuckets, ri, fph)
-		if addToBucket(&f.buckets[ri], f.bucketSize, fp) {
-			return true
-		}
+	return f.rnd.Intn(n)
+}
+
+// choose returns an int in [0, n) for kick k of fp at bucket i. It's random,
+// or under WithDeterministicPlacement derived from the arguments alone
+func choose(f *Filter, n int, fp fingerprint, i uint32, k uint16) int {
+	if !f.deterministic {
+		return intn(f, n)
 	}
 
-	return false
+	return int(fmix32(fmix32(uint32(fp)<<16|uint32(k))^i) % uint32(n))
 }
 
-// lookup checks if the item x existence in filter
-func lookup(f *Filter, x []byte) bool {
-	xh, xb := hashOf(x, f.hash)
-	fp := fingerprintOf(xb)
-	fph := fingerprintHash(fp, f.hash)
-	i1, i2 := indicesOf(xh, fph, f.totalBuckets)
+// victimOf returns the slot of the full bucket i to kick fp into after kicks kicks
+func victimOf(f *Filter, b bucket, fp fingerprint, i uint32, kicks uint16) int {
+	if f.victim == nil {
+		return choose(f, len(b.FPs), fp, i, kicks)
+	}
 
-	if containsIn(f.buckets[i1], f.bucketSize, fp) || containsIn(f.buckets[i2], f.bucketSize, fp) {
-		return true
+	f.victimFPs = f.victimFPs[:0]
+	for _, fp := range b.FPs {
+		f.victimFPs = append(f.victimFPs, Fingerprint(fp))
 	}
 
-	return false
-}
+	k := f.victim(f.victimFPs) % len(b.FPs)
+	if k < 0 {
+		k += len(b.FPs)
+	}
 
-// deleteItem deletes item if present from the filter
-func deleteItem(f *Filter, x []byte) (ok bool) {
-	xh, xb := hashOf(x, f.hash)
-	fp := fingerprintOf(xb)
-	fph := fingerprintHash(fp, f.hash)
-	i1, i2 := indicesOf(xh, fph, f.totalBuckets)
+	return k
+}
 
-	defer func() {
-		if ok {
-			f.count--
+// kickStartOf returns which of the full buckets i1 and i2 kicking fp starts from
+func kickStartOf(f *Filter, fp fingerprint, i1, i2 uint32) uint32 {
+	switch f.kickStart {
+	case PrimaryKickStart:
+		return i1
+	case LessFullKickStart:
+		if r1, r2 := roomAround(f, i1), roomAround(f, i2); r1 != r2 {
+			if r1 > r2 {
+				return i1
+			}
+
+			return i2
 		}
-	}()
-
-	if deleteFrom(&f.buckets[i1], f.bucketSize, fp) || deleteFrom(&f.buckets[i2], f.bucketSize, fp) {
-		return true
 	}
 
-	return false
+	return []uint32{i1, i2}[choose(f, 2, fp, i1, 0)]
 }
 
-// sanitize the bytes
-func sanitize(x []byte) ([]byte, bool) {
-	if len(x) == 0 {
-		return nil, false
+// roomAround returns the free slots in the alternate buckets of the
+// fingerprints in the full bucket i, where its victims would be kicked to
+func roomAround(f *Filter, i uint32) int {
+	var n int
+	for _, fp := range f.buckets[i].FPs {
+		alt := alternateIndex(f.indexing, f.totalBuckets, f.mask, i, altHash(f, fp))
+		n += int(f.bucketSize) - bits.OnesCount16(f.buckets[alt].Track)
 	}
 
-	if len(x) == 1 {
-		x = []byte{0, x[0]}
+	return n
+}
+
+// kick is a slot whose fingerprint got swapped out while inserting
+type kick struct {
+	bucket uint32
+	slot   int
+}
+
+// rollback undoes the kicks on the path in reverse, putting fp back into the
+// last kicked slot till the table is as it was before the insert
+func rollback(f *Filter, path []kick, fp fingerprint) {
+	for i := len(path) - 1; i >= 0; i-- {
+		fp = swapFingerprint(&f.buckets[path[i].bucket], path[i].slot, fp)
 	}
+}
 
-	return x, true
+// swapFingerprint swaps the fp at slot k of the bucket with provided fp
+func swapFingerprint(b *bucket, k int, fp fingerprint) fingerprint {
+	var sfp fingerprint
+	sfp, b.FPs[k] = b.FPs[k], fp
+	return sfp
 }
 
-// Insert inserts the item to the filter
-func (f *Filter) Insert(x []byte) bool {
-	f.L.Lock()
-	defer f.L.Unlock()
+// locate returns the fingerprint of item x and its two candidate buckets
+func locate(f *Filter, x []byte) (fp fingerprint, i1, i2 uint32) {
+	h := f.hashers.Get().(*hasher)
+	xh := keyHash(f, x, h)
+	binary.BigEndian.PutUint32(h.buf[:4], xh)
+	fp = fingerprintOf(h.buf[:4], f.order)
+	fph := indexHash(f, fp, h)
+	f.hashers.Put(h)
+	countHashes(f, 2)
+	i1, i2 = indicesOf(f.indexing, xh, fph, f.totalBuckets, f.mask)
+	return fp, i1, i2
+}
 
-	return f.UInsert(x)
+// altHash returns the hash of fp its alternate bucket is found with
+func altHash(f *Filter, fp fingerprint) uint32 {
+	h := f.hashers.Get().(*hasher)
+	fph := indexHash(f, fp, h)
+	f.hashers.Put(h)
+	countHashes(f, 1)
+	return fph
 }
 
-// UInsert inserts the item to the filter. Not thread safe
-func (f *Filter) UInsert(x []byte) bool {
-	if !isReliable(f) {
-		return false
+// countHashes adds n hash computations to the counter of WithHashCounting, if any
+func countHashes(f *Filter, n uint64) {
+	if f.hashOps != nil {
+		f.hashOps.Add(n)
 	}
+}
 
-	x, ok := sanitize(x)
-	if !ok {
-		return false
+// HashOps returns how many item and fingerprint hashes the filter computed
+// since it was built, or 0 without WithHashCounting. Doesn't take the lock
+func (f *Filter) HashOps() uint64 {
+	if f.hashOps == nil {
+		return 0
 	}
 
-	return insert(f, x)
+	return f.hashOps.Load()
 }
 
-// InsertUnique inserts only unique items
-func (f *Filter) InsertUnique(x []byte) bool {
-	f.L.Lock()
-	defer f.L.Unlock()
+// indexHash returns the hash of fp its alternate bucket is found with, under
+// the indexing scheme of f
+func indexHash(f *Filter, fp fingerprint, h *hasher) uint32 {
+	if f.indexing == AltSeedIndexing {
+		var b [2]byte
+		f.order.PutUint16(b[:], fp)
+		return murmur3Of2(b, f.seed^altSeedMask)
+	}
 
-	return f.UInsertUnique(x)
+	return fingerprintHash(fp, h, f.order)
 }
 
-// UInsertUnique inserts only unique items. Not thread safe
-func (f *Filter) UInsertUnique(x []byte) bool {
+// murmur3Of2 returns the 32 bit murmur3 hash of b with seed. The pooled hashers
+// are seeded with the filter seed, and the tail of a 2 byte input is all
+// murmur3 does for it
+func murmur3Of2(b [2]byte, seed uint32) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	k := uint32(b[1])<<8 | uint32(b[0])
+	k *= c1
+	k = bits.RotateLeft32(k, 15)
+	k *= c2
+
+	return fmix32(seed ^ k ^ 2)
+}
+
+// fmix32 is the finalizer of murmur3, mixing every bit of h into every other
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// insert inserts the item into filter
+func insert(f *Filter, x []byte) error {
+	fp, i1, i2 := locate(f, x)
+	return insertAt(f, fp, i1, i2)
+}
+
+// insertAt places the located fingerprint if the filter is reliable for another insert
+func insertAt(f *Filter, fp fingerprint, i1, i2 uint32) error {
+	_, err := insertTraced(f, fp, i1, i2)
+	return err
+}
+
+// insertTraced is insertAt also returning the kicks it took
+func insertTraced(f *Filter, fp fingerprint, i1, i2 uint32) (uint16, error) {
+	if addRef(f, fp, i1, i2) {
+		f.stats.record(nil, 0)
+		return 0, nil
+	}
+
 	if !isReliable(f) {
-		return false
+		f.stats.record(ErrFilterFull, 0)
+		return 0, ErrFilterFull
 	}
 
-	x, ok := sanitize(x)
-	if !ok {
-		return false
+	if atSoftCap(f) {
+		f.stats.record(ErrSoftCapReached, 0)
+		return 0, ErrSoftCapReached
 	}
 
-	if f.ULookup(x) {
-		return true
+	// kicking would only move other fingerprints around
+	if isSaturated(f, fp, i1, i2) {
+		f.stats.record(ErrMaxMultiplicity, 0)
+		return 0, ErrMaxMultiplicity
 	}
 
-	return insert(f, x)
+	return place(f, fp, i1, i2)
 }
 
-// Lookup checks if item exists in filter
-func (f *Filter) Lookup(x []byte) bool {
-	f.L.Lock()
-	defer f.L.Unlock()
-
-	return f.ULookup(x)
+// atSoftCap returns true if the filter takes no more inserts under WithSoftCap
+func atSoftCap(f *Filter) bool {
+	return f.softCap > 0 && f.ULoadFactor() >= f.softCap
 }
 
-// ULookup checks if item exists in filter. Not thread safe
-func (f *Filter) ULookup(x []byte) bool {
-	x, ok := sanitize(x)
-	if !ok {
-		return false
+// isSaturated returns true if the buckets i1 and i2 are full of fp alone
+func isSaturated(f *Filter, fp fingerprint, i1, i2 uint32) bool {
+	slots := 2 * int(f.bucketSize)
+	if i1 == i2 {
+		slots = int(f.bucketSize)
 	}
 
-	return lookup(f, x)
+	return countAt(f, fp, i1, i2) == slots
 }
 
-// Delete deletes the item from the filter
-func (f *Filter) Delete(x []byte) bool {
-	f.L.Lock()
-	defer f.L.Unlock()
+// place puts fp into one of its buckets i1 and i2, kicking other fingerprints
+// to their alternate buckets if both are full. Under WithEscalatingKicks a
+// failed attempt is retried with more kicks. Returns the kicks it took,
+// including those undone after a failure
+func place(f *Filter, fp fingerprint, i1, i2 uint32) (k uint16, err error) {
+	defer func() {
+		if err == nil {
+			f.count.Add(1)
+		}
 
-	return f.UDelete(x)
-}
+		f.stats.record(err, k)
+	}()
 
-// UDelete deletes the item from the filter. Not thread safe
-func (f *Filter) UDelete(x []byte) bool {
-	x, ok := sanitize(x)
-	if !ok {
-		return false
+	budget := f.maxKicks
+	k, err = kickIn(f, fp, i1, i2, budget)
+	for err == ErrFilterFull && f.kickStep > 0 && budget < f.kickLimit {
+		budget += min(f.kickStep, f.kickLimit-budget)
+		var n uint16
+		n, err = kickIn(f, fp, i1, i2, budget)
+		k += min(n, math.MaxUint16-k)
 	}
 
-	return deleteItem(f, x)
+	return k, err
 }
 
-// Count returns total inserted items into filter
-func (f *Filter) Count() uint32 {
-	f.L.RLock()
-	defer f.L.RUnlock()
+// kickIn puts fp into one of its buckets i1 and i2 like place, kicking at most
+// budget times before undoing the kicks. Not thread safe
+func kickIn(f *Filter, fp fingerprint, i1, i2 uint32, budget uint16) (k uint16, err error) {
+	if addToBucket(&f.buckets[i1], f.bucketSize, fp) || addToBucket(&f.buckets[i2], f.bucketSize, fp) {
+		return 0, nil
+	}
 
-	return f.UCount()
-}
+	ri := kickStartOf(f, fp, i1, i2)
+	path := f.path[:0]
+	defer func() {
+		f.path = path
+	}()
 
-// UCount returns total inserted items into filter. Not thread safe
-func (f *Filter) UCount() uint32 {
-	return f.count
+	var start time.Time
+	if f.kickTimeout > 0 {
+		start = time.Now()
+	}
+
+	err = ErrFilterFull
+	for k < budget {
+		if f.kickTimeout > 0 && k%kicksPerTimeCheck == kicksPerTimeCheck-1 && time.Since(start) > f.kickTimeout {
+			err = ErrTimeout
+			break
+		}
+
+		slot := victimOf(f, f.buckets[ri], fp, ri, k)
+		fp = swapFingerprint(&f.buckets[ri], slot, fp)
+		if f.evictHook != nil {
+			f.evictHook(ri, Fingerprint(fp))
+		}
+		path = append(path, kick{bucket: ri, slot: slot})
+		k++
+		ri = alternateIndex(f.indexing, f.totalBuckets, f.mask, ri, altHash(f, fp))
+		if addToBucket(&f.buckets[ri], f.bucketSize, fp) {
+			return k, nil
+		}
+	}
+
+	// the fingerprint in hand was kicked out of the table, undo the kicks so
+	// a failed insert doesn't lose an item that was already in
+	rollback(f, path, fp)
+	return k, err
 }
 
-// LoadFactor returns the load factor of the filter
-func (f *Filter) LoadFactor() float64 {
-	f.L.RLock()
-	defer f.L.RUnlock()
-	return f.ULoadFactor()
+// lookup checks if the item x existence in filter
+func lookup(f *Filter, x []byte) bool {
+	fp, i1, i2 := locate(f, x)
+	return lookupAt(f, x, fp, i1, i2)
 }
 
-// ULoadFactor returns the load factor of the filter. Not thread safe
-func (f *Filter) ULoadFactor() float64 {
-	return float64(f.count) / (float64(uint32(f.bucketSize) * f.totalBuckets))
+// lookupAt checks if the located item x exists in filter
+func lookupAt(f *Filter, x []byte, fp fingerprint, i1, i2 uint32) bool {
+	if containsIn(f.buckets[i1], f.bucketSize, fp) || containsIn(f.buckets[i2], f.bucketSize, fp) {
+		return true
+	}
+
+	return f.overflow != nil && f.overflow.contains(keyBytes(f, x))
 }
 
-// Encode gob encodes the filter to passed writer
-func (f *Filter) Encode(w io.Writer) error {
+// fitError returns ErrFilterFull for the insert errors meaning the item didn't
+// fit, for callers only telling those apart from the rest
+func fitError(err error) error {
+	if err == ErrMaxMultiplicity || err == ErrTimeout {
+		return ErrFilterFull
+	}
+
+	return err
+}
+
+// canSpill returns true if an item failing to insert with err can go to the
+// overflow bloom filter. An item at max multiplicity is already a member, so
+// spilling adds nothing, and spilling past the soft cap would raise the false
+// positive rate the cap is there to bound
+func canSpill(err error) bool {
+	return err != ErrMaxMultiplicity && err != ErrSoftCapReached
+}
+
+// spill adds the item that didn't fit to the overflow bloom filter, if any
+func spill(f *Filter, x []byte) bool {
+	if f.overflow == nil {
+		return false
+	}
+
+	f.overflow.add(keyBytes(f, x))
+	return true
+}
+
+// deleteItem deletes item if present from the filter
+func deleteItem(f *Filter, x []byte) bool {
+	fp, i1, i2 := locate(f, x)
+	if dropRef(f, fp, i1, i2) {
+		return true
+	}
+
+	if deleteFrom(&f.buckets[i1], f.bucketSize, fp) || deleteFrom(&f.buckets[i2], f.bucketSize, fp) {
+		dropCount(f, 1)
+		return true
+	}
+
+	return false
+}
+
+// dropCount takes n freed slots off the count under the write lock, stopping
+// at zero in case the count ever falls out of step with the buckets
+func dropCount(f *Filter, n uint32) {
+	c := f.count.Load()
+	f.count.Store(c - min(c, n))
+}
+
+// sanitize the bytes. Empty items are rejected and single byte items are padded
+// to two bytes, so {x} and {0, x} are the same item to the filter. Hashing the
+// length in would move every stored single byte item, so the aliasing is kept
+// for compatibility with encoded filters, WithLengthPrefix and WithStrictKeys
+// opt out of it. keyHash pads without allocating
+func sanitize(x []byte) ([]byte, bool) {
+	if len(x) == 0 {
+		return nil, false
+	}
+
+	if len(x) == 1 {
+		x = []byte{0, x[0]}
+	}
+
+	return x, true
+}
+
+// keyBytes returns the key the filter hashes for the item x from keyOf, for
+// the overflow bloom filter which needs it in one piece
+func keyBytes(f *Filter, x []byte) []byte {
+	if f.lengthPrefix {
+		return lengthPrefixed(x)
+	}
+
+	if f.strictKeys {
+		return x
+	}
+
+	x, _ = sanitize(x)
+	return x
+}
+
+// lengthPrefixed returns x with its length prefixed as a uvarint
+func lengthPrefixed(x []byte) []byte {
+	b := make([]byte, 0, binary.MaxVarintLen64+len(x))
+	b = binary.AppendUvarint(b, uint64(len(x)))
+	return append(b, x...)
+}
+
+// keyOf returns the transformed item, rejecting items past the max key size
+// and empty ones unless the keys are strict. The padding or length prefix of
+// the key is applied while hashing, see keyHash
+func keyOf(f *Filter, x []byte) ([]byte, error) {
+	if f.closed {
+		return nil, ErrClosed
+	}
+
+	if f.maxKeySize > 0 && len(x) > f.maxKeySize {
+		return nil, ErrKeyTooLarge
+	}
+
+	if f.transform != nil {
+		x = f.transform(x)
+	}
+
+	if len(x) == 0 && !f.strictKeys {
+		return nil, ErrInvalidInput
+	}
+
+	return x, nil
+}
+
+// Insert inserts the item to the filter. An insert that runs out of kicks
+// undoes them, so a failed insert leaves the filter as it was and never
+// loses an item it held
+func (f *Filter) Insert(x []byte) bool {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsert(x)
+}
+
+// UInsert inserts the item to the filter. Not thread safe
+func (f *Filter) UInsert(x []byte) bool {
+	return f.UInsertWithError(x) == nil
+}
+
+// InsertTraced inserts the item like Insert, also returning how many
+// fingerprints it kicked to make room. A failed insert reports the kicks it
+// undid, and an item spilled to the overflow bloom filter reports the kicks
+// of the failed attempt before it
+func (f *Filter) InsertTraced(x []byte) (ok bool, kicks int) {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertTraced(x)
+}
+
+// UInsertTraced inserts the item, also returning how many fingerprints it kicked. Not thread safe
+func (f *Filter) UInsertTraced(x []byte) (ok bool, kicks int) {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return false, 0
+	}
+
+	fp, i1, i2 := locate(f, x)
+	k, err := insertTraced(f, fp, i1, i2)
+	return err == nil || (canSpill(err) && spill(f, x)), int(k)
+}
+
+// InsertWithError inserts the item to the filter. Returns ErrInvalidInput if
+// the item can't be held, ErrFilterFull if there's no room for it,
+// ErrMaxMultiplicity if both its buckets are full of its copies,
+// ErrKeyTooLarge if it's longer than the max key size,
+// ErrSoftCapReached once the filter is loaded up to its soft cap,
+// ErrTimeout if kicking took longer than the kick timeout, or ErrClosed
+// after Close
+func (f *Filter) InsertWithError(x []byte) error {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertWithError(x)
+}
+
+// UInsertWithError inserts the item to the filter, returning why it couldn't. Not thread safe
+func (f *Filter) UInsertWithError(x []byte) error {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return err
+	}
+
+	err = insert(f, x)
+	if err != nil && canSpill(err) && spill(f, x) {
+		return nil
+	}
+
+	return err
+}
+
+// GetAndInsert inserts the item unless it's already a member, returning
+// whether it was. Both happen under one write lock and hash the item once, so
+// of concurrent callers with the same item only one sees it absent. A false
+// positive reads as present and isn't inserted, as with InsertUnique. The
+// errors are those of InsertWithError
+func (f *Filter) GetAndInsert(x []byte) (wasPresent bool, err error) {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UGetAndInsert(x)
+}
+
+// UGetAndInsert inserts the item unless it's already a member, returning whether it was. Not thread safe
+func (f *Filter) UGetAndInsert(x []byte) (wasPresent bool, err error) {
+	x, err = keyOf(f, x)
+	if err != nil {
+		return false, err
+	}
+
+	fp, i1, i2 := locate(f, x)
+	if lookupAt(f, x, fp, i1, i2) {
+		return true, nil
+	}
+
+	err = insertAt(f, fp, i1, i2)
+	if err != nil && canSpill(err) && spill(f, x) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// InsertRetry inserts the item, retrying up to attempts times if the insert fails.
+// Each attempt takes the lock on its own and the random kicks differ between attempts
+func (f *Filter) InsertRetry(x []byte, attempts int) bool {
+	for i := 0; i < attempts; i++ {
+		if f.Insert(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasRoom returns true if the bucket has an empty slot
+func hasRoom(b bucket, bs uint8) bool {
+	return b.Track != 1<<bs-1
+}
+
+// CanInsert returns true if the item has an empty slot in one of its buckets,
+// so an insert would succeed without kicking. It's false at the soft cap, where
+// inserts fail. Otherwise a false result only means the insert would need to
+// kick and may still succeed
+func (f *Filter) CanInsert(x []byte) bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UCanInsert(x)
+}
+
+// UCanInsert returns true if the item has an empty slot in one of its buckets. Not thread safe
+func (f *Filter) UCanInsert(x []byte) bool {
+	if atSoftCap(f) {
+		return false
+	}
+
+	x, err := keyOf(f, x)
+	if err != nil || !isReliable(f) {
+		return false
+	}
+
+	_, i1, i2 := locate(f, x)
+	return hasRoom(f.buckets[i1], f.bucketSize) || hasRoom(f.buckets[i2], f.bucketSize)
+}
+
+// InsertUnique inserts only unique items
+func (f *Filter) InsertUnique(x []byte) bool {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertUnique(x)
+}
+
+// UInsertUnique inserts only unique items. Not thread safe
+func (f *Filter) UInsertUnique(x []byte) bool {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return false
+	}
+
+	// hash once for both the lookup and the insert
+	fp, i1, i2 := locate(f, x)
+	if lookupAt(f, x, fp, i1, i2) {
+		return true
+	}
+
+	err = insertAt(f, fp, i1, i2)
+	return err == nil || (canSpill(err) && spill(f, x))
+}
+
+// Lookup checks if item exists in filter
+func (f *Filter) Lookup(x []byte) bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.ULookup(x)
+}
+
+// ULookup checks if item exists in filter. Not thread safe
+func (f *Filter) ULookup(x []byte) bool {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return false
+	}
+
+	return lookup(f, x)
+}
+
+// LookupConfidence checks if item exists in filter, along with how likely a
+// hit is the item itself rather than a collision. With m copies of the item's
+// fingerprint among the o occupied slots of its buckets, each slot holding a
+// given fingerprint of another item with chance q = 2^-16, the copies are
+// m / (o * q) times likelier to come from the item than from others alone, so
+// from even odds a hit has a confidence of m / (m + o * q). More copies raise
+// it and fuller buckets lower it. Hits in the overflow bloom filter get 1
+// minus its false positive rate. Misses are certain, so they have a
+// confidence of 1
+func (f *Filter) LookupConfidence(x []byte) (found bool, confidence float64) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.ULookupConfidence(x)
+}
+
+// ULookupConfidence checks if item exists in filter, along with how likely a hit is the item. Not thread safe
+func (f *Filter) ULookupConfidence(x []byte) (found bool, confidence float64) {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return false, 1
+	}
+
+	fp, i1, i2 := locate(f, x)
+	b1, b2 := f.buckets[i1], f.buckets[i2]
+	matches, occupied := countIn(b1, f.bucketSize, fp), bits.OnesCount16(b1.Track)
+	if i2 != i1 {
+		matches += countIn(b2, f.bucketSize, fp)
+		occupied += bits.OnesCount16(b2.Track)
+	}
+
+	if matches > 0 {
+		m := float64(matches)
+		return true, m / (m + float64(occupied)*math.Exp2(-fingerprintBits))
+	}
+
+	if f.overflow != nil && f.overflow.contains(keyBytes(f, x)) {
+		return true, 1 - bloomFPR
+	}
+
+	return false, 1
+}
+
+// LookupAny checks if the item exists in any of the filters, in order.
+// Each filter hashes the item itself, so they needn't share a configuration
+func LookupAny(filters []*Filter, x []byte) bool {
+	for _, f := range filters {
+		if f != nil && f.Lookup(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Missing returns the items that aren't in the filter, in the order passed.
+// Empty items are always missing. The returned slices are the passed ones, not copies
+func (f *Filter) Missing(items [][]byte) [][]byte {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UMissing(items)
+}
+
+// UMissing returns the items that aren't in the filter, in the order passed. Not thread safe
+func (f *Filter) UMissing(items [][]byte) [][]byte {
+	// hash a chunk of items before probing any of their buckets, so the
+	// bucket loads of a chunk follow each other
+	var missing [][]byte
+	var locs [lookupChunk]location
+	for len(items) > 0 {
+		chunk := items[:min(len(items), lookupChunk)]
+		for i, x := range chunk {
+			l := &locs[i]
+			if l.x, l.err = keyOf(f, x); l.err == nil {
+				l.fp, l.i1, l.i2 = locate(f, l.x)
+			}
+		}
+
+		for i, l := range locs[:len(chunk)] {
+			if l.err != nil || !lookupAt(f, l.x, l.fp, l.i1, l.i2) {
+				missing = append(missing, chunk[i])
+			}
+		}
+
+		items = items[len(chunk):]
+	}
+
+	return missing
+}
+
+// occupied returns copies of the stored fingerprints of the bucket
+func occupied(b bucket, bs uint8) []Fingerprint {
+	var fps []Fingerprint
+	for i := uint8(0); i < bs; i++ {
+		if isSet(b.Track, i) {
+			fps = append(fps, Fingerprint(b.FPs[i]))
+		}
+	}
+
+	return fps
+}
+
+// SnapshotIterator copies the stored fingerprints under the read lock and
+// returns an iterator over the copy, which holds no lock. Each call returns the
+// next fingerprint in bucket order, and false once they're all returned.
+// Changes to the filter after the copy aren't seen
+func (f *Filter) SnapshotIterator() func() (fp Fingerprint, ok bool) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.USnapshotIterator()
+}
+
+// USnapshotIterator copies the stored fingerprints and returns an iterator over the copy. Not thread safe
+func (f *Filter) USnapshotIterator() func() (fp Fingerprint, ok bool) {
+	fps := make([]Fingerprint, 0, f.count.Load())
+	for _, b := range f.buckets {
+		for i := uint8(0); i < f.bucketSize; i++ {
+			if isSet(b.Track, i) {
+				fps = append(fps, Fingerprint(b.FPs[i]))
+			}
+		}
+	}
+
+	return func() (Fingerprint, bool) {
+		if len(fps) == 0 {
+			return 0, false
+		}
+
+		fp := fps[0]
+		fps = fps[1:]
+		return fp, true
+	}
+}
+
+// BucketsFor returns copies of the stored fingerprints in the two candidate buckets of x
+func (f *Filter) BucketsFor(x []byte) (b1, b2 []Fingerprint) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UBucketsFor(x)
+}
+
+// UBucketsFor returns copies of the stored fingerprints in the two candidate buckets of x. Not thread safe
+func (f *Filter) UBucketsFor(x []byte) (b1, b2 []Fingerprint) {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return nil, nil
+	}
+
+	_, i1, i2 := locate(f, x)
+	return occupied(f.buckets[i1], f.bucketSize), occupied(f.buckets[i2], f.bucketSize)
+}
+
+// WouldCollide returns true if b would be a false positive of a filter holding
+// only a, having the same fingerprint and sharing a candidate bucket with it.
+// Identical items collide, and items the filter can't hold never do
+func (f *Filter) WouldCollide(a, b []byte) bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UWouldCollide(a, b)
+}
+
+// UWouldCollide returns true if b would be a false positive of a filter holding only a. Not thread safe
+func (f *Filter) UWouldCollide(a, b []byte) bool {
+	a, err := keyOf(f, a)
+	if err != nil {
+		return false
+	}
+
+	b, err = keyOf(f, b)
+	if err != nil {
+		return false
+	}
+
+	fpa, a1, a2 := locate(f, a)
+	fpb, b1, b2 := locate(f, b)
+	return fpa == fpb && (a1 == b1 || a1 == b2 || a2 == b1 || a2 == b2)
+}
+
+// Delete deletes the item from the filter
+func (f *Filter) Delete(x []byte) bool {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UDelete(x)
+}
+
+// UDelete deletes the item from the filter. Not thread safe
+func (f *Filter) UDelete(x []byte) bool {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return false
+	}
+
+	return deleteItem(f, x)
+}
+
+// reset empties the filter, keeping its geometry and configuration. Not thread safe
+func reset(f *Filter) {
+	for i := range f.buckets {
+		f.buckets[i].Track = 0
+		clear(f.buckets[i].FPs)
+	}
+
+	if f.overflow != nil {
+		clear(f.overflow.bits)
+	}
+
+	clear(f.refs)
+	f.count.Store(0)
+}
+
+// Reset empties the filter for reuse, clearing every bucket in place so none
+// are reallocated. The geometry, configuration and stats are kept
+func (f *Filter) Reset() {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	f.UReset()
+}
+
+// UReset empties the filter for reuse. Not thread safe
+func (f *Filter) UReset() {
+	reset(f)
+}
+
+// DeleteAt clears the slot of the bucket, returning false if either is out
+// of range or the slot is already empty. It's meant for repair tools removing
+// a known bad entry, deleting by item is Delete
+func (f *Filter) DeleteAt(bucket uint32, slot int) bool {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UDeleteAt(bucket, slot)
+}
+
+// UDeleteAt clears the slot of the bucket. Not thread safe
+func (f *Filter) UDeleteAt(bucket uint32, slot int) bool {
+	if f.closed || bucket >= f.totalBuckets || slot < 0 || slot >= int(f.bucketSize) {
+		return false
+	}
+
+	b := &f.buckets[bucket]
+	if !isSet(b.Track, uint8(slot)) {
+		return false
+	}
+
+	fp := b.FPs[slot]
+	b.FPs[slot] = emptyFingerprint
+	b.Track = unSet(b.Track, uint8(slot))
+	if f.refs != nil {
+		// references are only kept while a copy they add to is stored
+		i2 := alternateIndex(f.indexing, f.totalBuckets, f.mask, bucket, altHash(f, fp))
+		if countAt(f, fp, bucket, i2) == 0 {
+			delete(f.refs, refKeyOf(fp, bucket, i2))
+		}
+	}
+	dropCount(f, 1)
+	return true
+}
+
+// Close releases the buckets of the filter so their memory can be reclaimed
+// without waiting for the filter itself to be unreachable. Inserts fail with
+// ErrClosed afterwards, lookups and deletes return false and the count is 0.
+// Every other method returning an error returns ErrClosed too, including
+// merges and encodings with the filter on either side. Closing twice is a no-op
+func (f *Filter) Close() {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	f.UClose()
+}
+
+// UClose releases the buckets of the filter. Not thread safe
+func (f *Filter) UClose() {
+	f.closed = true
+	f.buckets = nil
+	f.path = nil
+	f.count.Store(0)
+}
+
+// Count returns total inserted items into filter. Doesn't take the lock
+func (f *Filter) Count() uint32 {
+	return f.UCount()
+}
+
+// UCount returns total inserted items into filter
+func (f *Filter) UCount() uint32 {
+	return f.count.Load()
+}
+
+// LoadFactor returns the load factor of the filter. Doesn't take the lock
+func (f *Filter) LoadFactor() float64 {
+	bs, tb := loadGeometry(f)
+	slots := float64(bs) * float64(tb)
+	if slots == 0 {
+		return 0
+	}
+
+	return float64(f.count.Load()) / slots
+}
+
+// ULoadFactor returns the load factor of the filter
+func (f *Filter) ULoadFactor() float64 {
+	slots := float64(f.bucketSize) * float64(f.totalBuckets)
+	if slots == 0 {
+		return 0
+	}
+
+	return float64(f.count.Load()) / slots
+}
+
+// IsPowerOfTwo returns true if the bucket count is a power of 2, which
+// StandardIndexing needs for the alternate of the alternate bucket to be the
+// bucket itself
+func (f *Filter) IsPowerOfTwo() bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UIsPowerOfTwo()
+}
+
+// UIsPowerOfTwo returns true if the bucket count is a power of 2. Not thread safe
+func (f *Filter) UIsPowerOfTwo() bool {
+	return isPowerOf2(f.totalBuckets)
+}
+
+// fingerprintMultiset returns how many times each fingerprint is stored in the filter
+func fingerprintMultiset(f *Filter) map[Fingerprint]int {
+	fps := make(map[Fingerprint]int)
+	for _, b := range f.buckets {
+		for i := uint8(0); i < f.bucketSize; i++ {
+			if isSet(b.Track, i) {
+				fps[Fingerprint(b.FPs[i])]++
+			}
+		}
+	}
+
+	return fps
+}
+
+// Items returns the stored fingerprints with their multiplicity. Slot order
+// doesn't matter, so filters holding the same fingerprints compare equal
+func (f *Filter) Items() map[Fingerprint]int {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return fingerprintMultiset(f)
+}
+
+// ForEach calls fn with the bucket and fingerprint of every occupied slot,
+// Count times in all, under the read lock, so fn must not modify the filter.
+// Fingerprints don't reconstruct the items, but with their buckets they're
+// enough to place them in another filter of the same geometry and hashing
+func (f *Filter) ForEach(fn func(bucketIndex uint32, fp Fingerprint)) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	f.UForEach(fn)
+}
+
+// UForEach calls fn with the bucket and fingerprint of every occupied slot.
+// Not thread safe
+func (f *Filter) UForEach(fn func(bucketIndex uint32, fp Fingerprint)) {
+	for bi, b := range f.buckets {
+		for i := uint8(0); i < f.bucketSize; i++ {
+			if isSet(b.Track, i) {
+				fn(uint32(bi), Fingerprint(b.FPs[i]))
+			}
+		}
+	}
+}
+
+// StateHash returns an FNV-64a hash of the geometry and contents of the filter.
+// Fingerprints are sorted within each bucket, so filters holding the same
+// fingerprints in the same buckets hash the same whatever their slot order
+func (f *Filter) StateHash() uint64 {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	h := fnv.New64a()
+	var b []byte
+	b = append(b, f.bucketSize)
+	b = binary.BigEndian.AppendUint32(b, f.totalBuckets)
+	b = append(b, headerOf(f).flags)
+	h.Write(b)
+
+	var fps [maxBucketSize]uint16
+	for _, bk := range f.buckets {
+		n := 0
+		for i := uint8(0); i < f.bucketSize; i++ {
+			if isSet(bk.Track, i) {
+				fps[n] = bk.FPs[i]
+				n++
+			}
+		}
+
+		slices.Sort(fps[:n])
+		b = append(b[:0], uint8(n))
+		for _, fp := range fps[:n] {
+			b = binary.BigEndian.AppendUint16(b, fp)
+		}
+
+		h.Write(b)
+	}
+
+	return h.Sum64()
+}
+
+// SampleFingerprints returns up to n stored fingerprints sampled uniformly
+func (f *Filter) SampleFingerprints(n int) []Fingerprint {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	if n <= 0 {
+		return nil
+	}
+
+	// reservoir sampling over the occupied slots
+	sample := make([]Fingerprint, 0, n)
+	var seen int
+	for _, b := range f.buckets {
+		for i := uint8(0); i < f.bucketSize; i++ {
+			if !isSet(b.Track, i) {
+				continue
+			}
+
+			seen++
+			if len(sample) < n {
+				sample = append(sample, Fingerprint(b.FPs[i]))
+				continue
+			}
+
+			if k := intn(f, seen); k < n {
+				sample[k] = Fingerprint(b.FPs[i])
+			}
+		}
+	}
+
+	return sample
+}
+
+// sameHashing returns true if a and b place the same item in the same buckets
+// with the same fingerprint, given the same geometry. Fingerprints are always
+// fingerprintBits wide, so the width can't differ
+func sameHashing(a, b *Filter) bool {
+	return a.seed == b.seed && a.hashID == b.hashID && a.lengthPrefix == b.lengthPrefix && a.strictKeys == b.strictKeys &&
+		a.order == b.order && a.indexing == b.indexing
+}
+
+// compatible returns why op can't combine the contents of a and b, if it can't
+func compatible(op string, a, b *Filter) error {
+	if a.closed || b.closed {
+		return ErrClosed
+	}
+
+	if a.bucketSize != b.bucketSize || a.totalBuckets != b.totalBuckets {
+		return fmt.Errorf("can't %s %d buckets of size %d with %d buckets of size %d",
+			op, a.totalBuckets, a.bucketSize, b.totalBuckets, b.bucketSize)
+	}
+
+	if !sameHashing(a, b) {
+		return fmt.Errorf("can't %s filters hashing keys differently", op)
+	}
+
+	return nil
+}
+
+// CompatibleWith returns true if f and other have the same geometry and hash
+// items the same way, so their fingerprints can be combined by Swap,
+// MergeMultiset and UnionCount
+func (f *Filter) CompatibleWith(other *Filter) bool {
+	unlock := rlockBoth(f, other)
+	defer unlock()
+
+	return compatible("compare", f, other) == nil
+}
+
+// lockBoth write locks both filters ordered by address so that two goroutines
+// locking the same pair in opposite order can't deadlock
+func lockBoth(a, b *Filter) (unlock func()) {
+	if uintptr(unsafe.Pointer(a)) > uintptr(unsafe.Pointer(b)) {
+		a, b = b, a
+	}
+
+	a.L.Lock()
+	b.L.Lock()
+	return func() {
+		b.L.Unlock()
+		a.L.Unlock()
+	}
+}
+
+// sameOverflow returns true if a and b have overflow bloom filters of the same
+// size, or neither has one
+func sameOverflow(a, b *Filter) bool {
+	if a.overflow == nil || b.overflow == nil {
+		return a.overflow == b.overflow
+	}
+
+	return len(a.overflow.bits) == len(b.overflow.bits) && a.overflow.hashes == b.overflow.hashes
+}
+
+// Swap exchanges the contents of f and other, the items spilled to their
+// overflow bloom filters included. Both filters must have the same geometry,
+// either both or neither use WithDeleteSafety so the references move with the
+// fingerprints they count, and their overflow bloom filters must be of the
+// same size. Stats stay with each filter
+func (f *Filter) Swap(other *Filter) error {
+	if f == other {
+		return nil
+	}
+
+	unlock := lockBoth(f, other)
+	defer unlock()
+
+	if err := compatible("swap", f, other); err != nil {
+		return err
+	}
+
+	if (f.refs == nil) != (other.refs == nil) {
+		return fmt.Errorf("can't swap filters with and without delete safety")
+	}
+
+	if !sameOverflow(f, other) {
+		return fmt.Errorf("can't swap filters with different overflow bloom filters")
+	}
+
+	f.buckets, other.buckets = other.buckets, f.buckets
+	f.refs, other.refs = other.refs, f.refs
+	f.overflow, other.overflow = other.overflow, f.overflow
+	fc := f.count.Load()
+	f.count.Store(other.count.Load())
+	other.count.Store(fc)
+	return nil
+}
+
+// load replaces the contents of f and the configuration stored with them with
+// those of nf, a filter nothing else holds, for unmarshaling into an existing
+// filter. The options the format doesn't carry stay as f was built, while the
+// items spilled to its overflow bloom filter and its references go with the
+// contents they were for. Returns ErrClosed if f is closed
+func (f *Filter) load(nf *Filter) error {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+
+	f.count.Store(nf.count.Load())
+	f.buckets = nf.buckets
+	f.bucketSize = nf.bucketSize
+	f.totalBuckets = nf.totalBuckets
+	f.mask = nf.mask
+	setGeometry(f)
+	f.hashers = nf.hashers
+	f.hashID = nf.hashID
+	f.customHash = nf.customHash
+	f.seed = nf.seed
+	f.maxKicks = nf.maxKicks
+	f.lengthPrefix = nf.lengthPrefix
+	f.strictKeys = nf.strictKeys
+	f.order = nf.order
+	f.indexing = nf.indexing
+	if f.overflow != nil {
+		clear(f.overflow.bits)
+	}
+
+	clear(f.refs)
+	f.path = nil
+	return nil
+}
+
+// isClosed returns if the filter is closed, taking the read lock
+func isClosed(f *Filter) bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.closed
+}
+
+// Encode gob encodes the filter to passed writer.
+// Filters loaded below sparseLoadFactor are encoded as their occupied slots only
+func (f *Filter) Encode(w io.Writer) error {
 	// hold the read lock till we encode the data to the writer
 	f.L.RLock()
 	defer f.L.RUnlock()
+	if f.closed {
+		return ErrClosed
+	}
+
 	gf := &gobFilter{
-		Count:        f.count,
-		Buckets:      f.buckets,
+		Version:      gobVersion,
+		Seed:         f.seed,
+		Count:        f.count.Load(),
 		BucketSize:   f.bucketSize,
 		TotalBuckets: f.totalBuckets,
 		MaxKicks:     f.maxKicks,
+		LengthPrefix: f.lengthPrefix,
+		LittleEndian: f.order == binary.LittleEndian,
+		Indexing:     f.indexing,
+		StrictKeys:   f.strictKeys,
+	}
+
+	if f.customHash {
+		gf.CustomHash, gf.HashID = true, f.hashID
+	}
+
+	if f.overflow != nil {
+		gf.Overflow = f.overflow.bits
+		gf.OverflowHashes = f.overflow.hashes
+	}
+
+	if f.ULoadFactor() < sparseLoadFactor {
+		gf.Sparse = true
+		gf.Entries = sparseEntries(f.buckets, f.bucketSize)
+	} else {
+		gf.Buckets = f.buckets
 	}
 
 	ge := gob.NewEncoder(w)
 	return ge.Encode(gf)
 }
 
-// Decode decodes and returns the filter instance
-func Decode(r io.Reader) (*Filter, error) {
+// Decode decodes and returns the filter instance. The count is recomputed
+// from the stored fingerprints, see WithStrictLoad
+func Decode(r io.Reader, opts ...LoadOption) (*Filter, error) {
 	gd := gob.NewDecoder(r)
 	gf := &gobFilter{}
 	err := gd.Decode(gf)
@@ -437,13 +1886,53 @@ func Decode(r io.Reader) (*Filter, error) {
 		return nil, fmt.Errorf("failed to decode filter: %v", err)
 	}
 
+	if gf.Version > gobVersion {
+		return nil, fmt.Errorf("failed to decode filter: unsupported version %d", gf.Version)
+	}
+
+	if gf.Indexing > AltSeedIndexing {
+		return nil, fmt.Errorf("failed to decode filter: unknown indexing scheme %d", gf.Indexing)
+	}
+
+	hashers, err := loadHash(gf.CustomHash, gf.HashID, ^uint32(0), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode filter: %w", err)
+	}
+
+	if gf.Sparse {
+		gf.Buckets, err = bucketsFromEntries(gf.Entries, gf.TotalBuckets, gf.BucketSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode filter: %v", err)
+		}
+	}
+
 	f := &Filter{
-		count:        gf.Count,
 		buckets:      gf.Buckets,
 		bucketSize:   gf.BucketSize,
 		totalBuckets: gf.TotalBuckets,
-		hash:         murmur3.New32WithSeed(seed),
+		mask:         bucketMask(gf.TotalBuckets),
+		hashers:      hasherPool(defaultHash),
+		seed:         seed,
 		maxKicks:     gf.MaxKicks,
+		lengthPrefix: gf.LengthPrefix,
+		order:        binary.BigEndian,
+		indexing:     gf.Indexing,
+		strictKeys:   gf.StrictKeys,
+	}
+	setGeometry(f)
+	if gf.LittleEndian {
+		f.order = binary.LittleEndian
+	}
+	if gf.Version > 0 && gf.Seed != seed {
+		f.seed, f.hashers = gf.Seed, hasherPool(murmurHash(gf.Seed))
+	}
+	f.hashID = hashIDOf(f.hashers)
+	setHash(f, hashers)
+	if err := loadCount(f, gf.Count, opts); err != nil {
+		return nil, fmt.Errorf("failed to decode filter: %w", err)
+	}
+	if len(gf.Overflow) > 0 {
+		f.overflow = &bloomFilter{bits: gf.Overflow, hashes: gf.OverflowHashes}
 	}
 
 	return f, nil
@@ -3,10 +3,18 @@ package cuckoo
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spaolacci/murmur3"
 )
@@ -30,10 +38,10 @@ func Test_fingerprintOf(t *testing.T) {
 		},
 	}
 
-	h := murmur3.New32WithSeed(1234)
+	h := &hasher{Hash32: murmur3.New32WithSeed(1234)}
 	for _, c := range tests {
-		fp := fingerprintOf(c.b)
-		fph := fingerprintHash(fp, h)
+		fp := fingerprintOf(c.b, binary.BigEndian)
+		fph := fingerprintHash(fp, h, binary.BigEndian)
 		if c.r != fp {
 			t.Fatalf("expected %v bytes but got %v", c.r, fp)
 		}
@@ -78,6 +86,59 @@ func Test_addToBucket(t *testing.T) {
 	}
 }
 
+func Test_zeroFingerprint(t *testing.T) {
+	f := newFilter(4, 4, hasherPool(defaultHash))
+	b := &f.buckets[1]
+	if containsIn(*b, f.bucketSize, 0) {
+		t.Fatalf("expected empty slots not to match fingerprint 0")
+	}
+
+	if !addToBucket(b, f.bucketSize, 0) || !addToBucket(b, f.bucketSize, 7) {
+		t.Fatalf("expected fingerprints to be added")
+	}
+
+	if !containsIn(*b, f.bucketSize, 0) || countIn(*b, f.bucketSize, 0) != 1 {
+		t.Fatalf("expected a single fingerprint 0 to be stored")
+	}
+
+	if !deleteFrom(b, f.bucketSize, 0) || containsIn(*b, f.bucketSize, 0) || deleteFrom(b, f.bucketSize, 0) {
+		t.Fatalf("expected fingerprint 0 to be deleted once")
+	}
+
+	if !containsIn(*b, f.bucketSize, 7) || b.Track != 1<<1 {
+		t.Fatalf("expected only fingerprint 7 to remain but got track %b", b.Track)
+	}
+}
+
+func TestFilter_zeroFingerprintItem(t *testing.T) {
+	f := NewFilter(1 << 10)
+	var x []byte
+	for i := 0; x == nil; i++ {
+		y := []byte(fmt.Sprintf("item-%d", i))
+		if fp, _, _ := locate(f, y); fp == 0 {
+			x = y
+		}
+	}
+
+	if !f.Insert(x) || !f.Lookup(x) || f.CountOf(x) != 1 {
+		t.Fatalf("expected %s with fingerprint 0 to be stored", x)
+	}
+
+	// the empty slots around it don't match or get deleted
+	for _, df := range []func() (*Filter, error){
+		func() (*Filter, error) { b, _ := f.MarshalBinary(); return ReadFrom(bytes.NewReader(b)) },
+		func() (*Filter, error) { var b bytes.Buffer; f.Encode(&b); return Decode(&b) },
+	} {
+		if df, err := df(); err != nil || !df.Lookup(x) || df.Count() != 1 {
+			t.Fatalf("expected %s to survive a round trip: %v", x, err)
+		}
+	}
+
+	if !f.Delete(x) || f.Lookup(x) || f.Delete(x) || f.Count() != 0 {
+		t.Fatalf("expected %s to be deleted once", x)
+	}
+}
+
 func TestFilter_Insert(t *testing.T) {
 	tests := []struct {
 		item  string
@@ -108,6 +169,100 @@ func TestFilter_Insert(t *testing.T) {
 	}
 }
 
+func TestFilter_InsertRetry(t *testing.T) {
+	f := NewFilter(1 << 10)
+	if !f.InsertRetry([]byte("hello"), 3) || !f.Lookup([]byte("hello")) {
+		t.Fatalf("expected item to be inserted")
+	}
+
+	if f.InsertRetry([]byte("hello"), 0) {
+		t.Fatalf("expected no insert without attempts")
+	}
+
+	if f.Count() != 1 {
+		t.Fatalf("expected 1 count but got %d", f.Count())
+	}
+}
+
+func TestFilter_InsertFailureKeepsItems(t *testing.T) {
+	f := NewFilter(1 << 6)
+	f.maxKicks = 5
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		if f.Insert(x) {
+			items = append(items, x)
+		}
+	}
+
+	if len(items) == 1000 {
+		t.Fatalf("expected the filter to fill up")
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed after failed inserts: %s", x)
+		}
+	}
+
+	// a failed insert that kicked leaves every slot as it was. Small buckets
+	// fail kicking well before the load cap, placed the same way every run
+	f, err := NewWithOptions(WithCapacity(1<<8), WithBucketSize(2), WithMaxKicks(5), WithDeterministicPlacement())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var kicked int
+	for i := 0; i < 1000; i++ {
+		before := make([]bucket, len(f.buckets))
+		for j, b := range f.buckets {
+			before[j] = bucket{Track: b.Track, FPs: append([]fingerprint(nil), b.FPs...)}
+		}
+
+		if ok, kicks := f.InsertTraced([]byte(fmt.Sprintf("item-%d", i))); ok || kicks == 0 {
+			continue
+		}
+
+		kicked++
+		if !reflect.DeepEqual(before, f.buckets) {
+			t.Fatalf("expected a failed insert to leave the buckets unchanged")
+		}
+	}
+
+	if kicked == 0 {
+		t.Fatalf("expected an insert to fail after kicking")
+	}
+}
+
+func TestFilter_CanInsert(t *testing.T) {
+	f := NewFilter(1 << 6)
+	for i := 0; i < 1000; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		can := f.CanInsert(x)
+		if f.Insert(x) != can && can {
+			t.Fatalf("expected insert to succeed when it can")
+		}
+	}
+
+	if f.CanInsert([]byte("more")) || f.CanInsert(nil) {
+		t.Fatalf("expected no room in a full filter")
+	}
+
+	// a filter at its soft cap has empty slots but takes no inserts
+	capped, _ := NewWithOptions(WithCapacity(1000), WithSoftCap(0.5))
+	for i := 0; capped.Insert([]byte(fmt.Sprintf("item-%d", i))); i++ {
+	}
+
+	x := []byte("more")
+	if _, i1, i2 := locate(capped, x); !hasRoom(capped.buckets[i1], capped.bucketSize) && !hasRoom(capped.buckets[i2], capped.bucketSize) {
+		t.Fatalf("expected room for the item at half load")
+	}
+
+	if capped.CanInsert(x) || capped.InsertWithError(x) != ErrSoftCapReached {
+		t.Fatalf("expected no inserts at the soft cap")
+	}
+}
+
 func TestFilter_Exists(t *testing.T) {
 	f := StdFilter()
 	for _, s := range []string{"hello", "hello, World", "This Worked"} {
@@ -146,6 +301,75 @@ func TestFilter_Exists(t *testing.T) {
 	}
 }
 
+func TestLookupAny(t *testing.T) {
+	ring := []*Filter{NewFilter(1 << 10), nil, NewFilter(1 << 10)}
+	ring[0].Insert([]byte("monday"))
+	ring[2].Insert([]byte("wednesday"))
+	for _, s := range []string{"monday", "wednesday"} {
+		if !LookupAny(ring, []byte(s)) {
+			t.Fatalf("expected %s in the ring", s)
+		}
+	}
+
+	if LookupAny(ring, []byte("tuesday")) || LookupAny(nil, []byte("monday")) {
+		t.Fatalf("unexpected match")
+	}
+}
+
+func TestFilter_Missing(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for _, s := range []string{"hello", "This Worked"} {
+		f.Insert([]byte(s))
+	}
+
+	items := [][]byte{[]byte("hello"), []byte("hello, World"), nil, []byte("This Worked"), []byte("This is test")}
+	missing := f.Missing(items)
+	expected := [][]byte{[]byte("hello, World"), nil, []byte("This is test")}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("expected %q missing but got %q", expected, missing)
+	}
+}
+
+func TestFilter_BucketsFor(t *testing.T) {
+	f := NewFilter(1 << 10)
+	f.Insert([]byte("hello"))
+	b1, b2 := f.BucketsFor([]byte("hello"))
+	fp, _, _ := locate(f, []byte("hello"))
+	if len(b1)+len(b2) != 1 || append(b1, b2...)[0] != Fingerprint(fp) {
+		t.Fatalf("expected only the item fingerprint %d but got %v and %v", fp, b1, b2)
+	}
+
+	// copies can't change the filter
+	append(b1, b2...)[0]++
+	if !f.Lookup([]byte("hello")) {
+		t.Fatalf("expected the filter to be untouched")
+	}
+
+	if b1, b2 := f.BucketsFor(nil); b1 != nil || b2 != nil {
+		t.Fatalf("expected no buckets for an empty item")
+	}
+}
+
+func TestFilter_ShortItems(t *testing.T) {
+	f := NewFilter(1 << 10)
+	if f.Insert([]byte{}) || f.Lookup(nil) {
+		t.Fatalf("expected empty items to be rejected")
+	}
+
+	f.Insert([]byte{5})
+	if !f.Lookup([]byte{0, 5}) {
+		t.Fatalf("expected {5} and {0, 5} to alias")
+	}
+
+	if f.Lookup([]byte{5, 0}) {
+		t.Fatalf("expected {5} and {5, 0} to differ")
+	}
+
+	if !f.Delete([]byte{0, 5}) || f.Lookup([]byte{5}) {
+		t.Fatalf("expected deleting {0, 5} to remove {5}")
+	}
+}
+
 func TestFilter_Delete(t *testing.T) {
 	f := StdFilter()
 	for _, s := range []string{"hello", "hello, World", "This Worked"} {
@@ -193,6 +417,227 @@ func TestFilter_Delete(t *testing.T) {
 	}
 }
 
+func TestFilter_DeleteUnderflow(t *testing.T) {
+	f := NewFilter(1 << 10)
+	if f.Delete([]byte("hello")) || f.Count() != 0 {
+		t.Fatalf("expected delete on empty filter to leave count 0 but got %d", f.Count())
+	}
+
+	// stored fingerprint with a count that's out of step
+	f.Insert([]byte("hello"))
+	f.count.Store(0)
+	if !f.Delete([]byte("hello")) || f.Count() != 0 {
+		t.Fatalf("expected count to stay 0 but got %d", f.Count())
+	}
+}
+
+func TestFilter_InsertWithError(t *testing.T) {
+	// a single bucket is full after as many items as it has slots
+	full := NewFilter(defaultBucketSize - 1)
+	for i := 0; i < defaultBucketSize; i++ {
+		full.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	tests := []struct {
+		name string
+		f    *Filter
+		x    []byte
+		err  error
+	}{
+		{"nil", NewFilter(1 << 6), nil, ErrInvalidInput},
+		{"empty", NewFilter(1 << 6), []byte{}, ErrInvalidInput},
+		{"full", full, []byte("one more"), ErrFilterFull},
+		{"inserted", NewFilter(1 << 6), []byte("gopher"), nil},
+	}
+
+	for _, c := range tests {
+		count := c.f.Count()
+		if err := c.f.InsertWithError(c.x); !errors.Is(err, c.err) {
+			t.Fatalf("%s: expected %v but got %v", c.name, c.err, err)
+		}
+
+		if c.err != nil && (c.f.Count() != count || c.f.Insert(c.x)) {
+			t.Fatalf("%s: expected the filter unchanged and Insert to fail", c.name)
+		}
+	}
+}
+
+func TestFilter_MaxMultiplicity(t *testing.T) {
+	f := NewFilter(1 << 6)
+	x := []byte("hello")
+	var inserted int
+	for i := 0; i < 100; i++ {
+		err := f.InsertWithError(x)
+		if err == nil {
+			inserted++
+			continue
+		}
+
+		if err != ErrMaxMultiplicity {
+			t.Fatalf("expected %v but got %v", ErrMaxMultiplicity, err)
+		}
+	}
+
+	copies := 2 * int(f.bucketSize)
+	if inserted != copies || f.Count() != uint32(copies) {
+		t.Fatalf("expected %d copies but inserted %d", copies, inserted)
+	}
+
+	if st := f.Stats(); st.Kicks != 0 || st.Failures != uint64(100-copies) {
+		t.Fatalf("expected failures without kicking but got %+v", st)
+	}
+
+	if !f.Insert([]byte("world")) || !f.Lookup([]byte("world")) {
+		t.Fatalf("expected other items to still fit")
+	}
+}
+
+func Test_keyHash(t *testing.T) {
+	f := NewFilter(1 << 10)
+	h := &hasher{Hash32: murmur3.New32WithSeed(seed)}
+	x := []byte("123456789")
+	for i := 1; i <= len(x); i++ {
+		for _, lp := range []bool{false, true} {
+			f.lengthPrefix = lp
+			want := hashOf(keyBytes(f, x[:i]), murmur3.New32WithSeed(seed))
+			if got := keyHash(f, x[:i], h); got != want {
+				t.Fatalf("expected hash %d of %q but got %d", want, x[:i], got)
+			}
+		}
+	}
+}
+
+func TestFilter_NoRetention(t *testing.T) {
+	f := NewFilter(1 << 10)
+	buf := []byte("hello")
+	for _, n := range []int{1, len(buf)} {
+		if raceEnabled {
+			break
+		}
+
+		x := buf[:n]
+		if allocs := testing.AllocsPerRun(100, func() {
+			f.Insert(x)
+			f.Lookup(x)
+			f.Delete(x)
+		}); allocs != 0 {
+			t.Fatalf("expected no allocations for %d byte items but got %v", n, allocs)
+		}
+	}
+
+	// reusing the buffer doesn't change what the filter holds
+	f.Insert(buf)
+	copy(buf, "world")
+	if !f.Lookup([]byte("hello")) || f.Lookup(buf) {
+		t.Fatalf("expected the inserted item to be unaffected by the buffer")
+	}
+}
+
+func TestFilter_Reset(t *testing.T) {
+	f := NewFilter(1 << 10)
+	var items [][]byte
+	for i := 0; i < 500; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		f.Insert(x)
+		items = append(items, x)
+	}
+
+	first := &f.buckets[0].FPs[0]
+	f.Reset()
+	if f.Count() != 0 || f.LoadFactor() != 0 || &f.buckets[0].FPs[0] != first {
+		t.Fatalf("expected an empty filter over the same buckets")
+	}
+
+	for _, x := range items {
+		if f.Lookup(x) {
+			t.Fatalf("expected %s to be gone after a reset", x)
+		}
+	}
+
+	if !f.Insert(items[0]) || !f.Lookup(items[0]) || f.Count() != 1 {
+		t.Fatalf("expected a reset filter to be usable")
+	}
+}
+
+func TestFilter_Close(t *testing.T) {
+	f := NewFilter(1 << 10)
+	x := []byte("hello")
+	f.Insert(x)
+	f.Close()
+	f.Close()
+
+	if f.buckets != nil {
+		t.Fatal("expected buckets to be released")
+	}
+
+	if f.Count() != 0 || f.LoadFactor() != 0 {
+		t.Fatalf("expected empty filter after close but got count %d", f.Count())
+	}
+
+	if err := f.InsertWithError(x); err != ErrClosed {
+		t.Fatalf("expected %v but got %v", ErrClosed, err)
+	}
+
+	if f.Insert(x) || f.InsertUnique(x) || f.Lookup(x) || f.Delete(x) || f.CanInsert(x) {
+		t.Fatal("expected operations on a closed filter to fail")
+	}
+
+	if b1, b2 := f.BucketsFor(x); b1 != nil || b2 != nil {
+		t.Fatalf("expected no buckets but got %v %v", b1, b2)
+	}
+
+	open := NewFilter(1 << 10)
+	open.Insert(x)
+	snapshot, _ := open.MarshalBinary()
+	text, _ := open.MarshalText()
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "Encode", call: func() error { return f.Encode(io.Discard) }},
+		{name: "MarshalText", call: func() error { _, err := f.MarshalText(); return err }},
+		{name: "UnmarshalBinary", call: func() error { return f.UnmarshalBinary(snapshot) }},
+		{name: "UnmarshalText", call: func() error { return f.UnmarshalText(text) }},
+		{name: "UnmarshalText of bad text", call: func() error { return f.UnmarshalText([]byte("!")) }},
+		{name: "WriteToParallel", call: func() error { return f.WriteToParallel(nil, 2) }},
+		{name: "GrowBuckets", call: func() error { return f.GrowBuckets(16) }},
+		{name: "Halve", call: func() error { _, err := f.Halve(); return err }},
+		{name: "InsertAll", call: func() error { return errors.Unwrap(f.InsertAll([][]byte{x})) }},
+		{name: "InsertReader", call: func() error { _, err := f.InsertReader(bytes.NewReader(x)); return err }},
+		{name: "LookupReader", call: func() error { _, err := f.LookupReader(bytes.NewReader(x)); return err }},
+		{name: "MergeMultiset", call: func() error { return f.MergeMultiset(open, MergeSum) }},
+		{name: "MergeMultiset from", call: func() error { return open.MergeMultiset(f, MergeSum) }},
+		{name: "Swap", call: func() error { return open.Swap(f) }},
+		{name: "UnionCount", call: func() error { _, err := UnionCount(open, f); return err }},
+		{name: "NewAndFilter", call: func() error { _, err := NewAndFilter(f, open); return err }},
+	}
+
+	for _, c := range tests {
+		if err := c.call(); err != ErrClosed {
+			t.Fatalf("%s: expected %v but got %v", c.name, ErrClosed, err)
+		}
+	}
+
+	if !open.Lookup(x) || open.Count() != 1 || open.CompatibleWith(f) {
+		t.Fatalf("expected the open filter to be untouched")
+	}
+
+	for _, ok := range []bool{f.InsertHashed(1, 2), f.LookupHashed(1, 2), f.DeleteHashed(1, 2), f.DeleteAt(0, 0), f.WouldCollide(x, x)} {
+		if ok {
+			t.Fatalf("expected operations on a closed filter to fail")
+		}
+	}
+
+	if f.InsertN(x, 2) != 0 || f.DeleteAll(x) != 0 || f.CountOf(x) != 0 || len(f.Missing([][]byte{x})) != 1 ||
+		f.BucketDetail(0) != nil || f.BucketLoad(0) != -1 || len(f.Items()) != 0 || len(f.SampleFingerprints(1)) != 0 {
+		t.Fatalf("expected a closed filter to hold nothing")
+	}
+
+	if _, ok := f.SnapshotIterator()(); ok {
+		t.Fatalf("expected no fingerprints to iterate")
+	}
+}
+
 func TestFilter_EncodeDecode(t *testing.T) {
 	f := StdFilter()
 	data := []string{"hello", "hello, World", "This Worked"}
@@ -211,7 +656,7 @@ func TestFilter_EncodeDecode(t *testing.T) {
 		t.Fatalf("unexpected error while decoding: %v", err)
 	}
 
-	if f.count != df.count {
+	if f.count.Load() != df.count.Load() {
 		t.Fatalf("count mismatch")
 	}
 
@@ -227,6 +672,10 @@ func TestFilter_EncodeDecode(t *testing.T) {
 		t.Fatalf("maxkicks mismatch")
 	}
 
+	if !reflect.DeepEqual(f.Items(), df.Items()) {
+		t.Fatalf("items mismatch")
+	}
+
 	if !reflect.DeepEqual(f.buckets, df.buckets) {
 		t.Fatalf("buckets mismatch")
 	}
@@ -238,98 +687,996 @@ func TestFilter_EncodeDecode(t *testing.T) {
 	}
 }
 
-func Test_nextPowerOf2(t *testing.T) {
+func TestNewFilterWithBucketSize_capacity(t *testing.T) {
 	tests := []struct {
-		v uint32
-		e uint32
+		count   uint32
+		bs      uint8
+		buckets uint32
+		err     error
 	}{
 		{
-			v: 1,
-			e: 4,
+			count:   1000,
+			bs:      8,
+			buckets: 128,
 		},
 
 		{
-			v: 2,
-			e: 4,
+			count:   1024,
+			bs:      8,
+			buckets: 256,
 		},
 
 		{
-			v: 3,
-			e: 4,
+			count:   1 << 16,
+			bs:      16,
+			buckets: 1 << 13,
 		},
 
 		{
-			v: 4,
-			e: 4,
+			count:   1 << 30,
+			bs:      16,
+			buckets: 1 << 27,
 		},
 
 		{
-			v: 100,
-			e: 128,
+			count: 1 << 31,
+			bs:    4,
+			err:   ErrCapacityTooTight,
+		},
+
+		{
+			count: math.MaxUint32,
+			bs:    16,
+			err:   ErrCapacityTooTight,
 		},
 	}
 
 	for _, c := range tests {
-		g := nextPowerOf2(c.v)
-		if g != c.e {
-			t.Fatalf("expected %d but got %d", c.e, g)
+		if c.err != nil {
+			if _, err := NewFilterWithBucketSize(c.count, c.bs); !errors.Is(err, c.err) {
+				t.Fatalf("expected %v for %d items but got %v", c.err, c.count, err)
+			}
+
+			if _, err := NewWithOptions(WithCapacity(c.count), WithBucketSize(c.bs)); !errors.Is(err, c.err) {
+				t.Fatalf("expected %v for %d items but got %v", c.err, c.count, err)
+			}
+
+			continue
+		}
+
+		b, err := bucketsFor(c.count, c.bs)
+		if err != nil {
+			t.Fatalf("unexpected error for %d items: %v", c.count, err)
+		}
+
+		if b != c.buckets {
+			t.Fatalf("expected %d buckets for %d items but got %d", c.buckets, c.count, b)
+		}
+
+		// every constructor sizes the same way, checked where it's cheap to build
+		if c.count <= 1<<16 {
+			f, _ := NewFilterWithBucketSize(c.count, c.bs)
+			of, _ := NewWithOptions(WithCapacity(c.count), WithBucketSize(c.bs))
+			if f.totalBuckets != b || of.totalBuckets != b {
+				t.Fatalf("expected %d buckets for %d items but got %d and %d", b, c.count, f.totalBuckets, of.totalBuckets)
+			}
+
+			if c.bs == defaultBucketSize && NewFilter(c.count).totalBuckets != b {
+				t.Fatalf("expected NewFilter to size %d items to %d buckets", c.count, b)
+			}
+		}
+
+		if float64(c.count) > estimatedLoadFactor(c.bs)*float64(c.buckets*uint32(c.bs)) {
+			t.Fatalf("expected %d items to fit the safe load of %d buckets", c.count, c.buckets)
+		}
+	}
+
+	f, err := NewFilterWithBucketSize(1024, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1024; i++ {
+		if !f.Insert([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("expected all 1024 items to fit but item %d failed", i)
 		}
 	}
 }
 
-// Benchmark tests taken from https://github.com/mtchavez/cuckoo
-var filter *Filter
-var okay bool
+func TestNewFilter_tiny(t *testing.T) {
+	for _, count := range []uint32{0, 1, 7} {
+		f := NewFilter(count)
+		if f.totalBuckets != 1 || f.LoadFactor() != 0 {
+			t.Fatalf("expected a single empty bucket for %d items but got %d", count, f.totalBuckets)
+		}
 
-func BenchmarkCuckooNew(b *testing.B) {
-	b.ReportAllocs()
-	var f *Filter
-	for i := 0; i < b.N; i++ {
-		f = StdFilter()
+		x := []byte("hello")
+		if !f.Insert(x) || !f.Lookup(x) || f.LoadFactor() != 1.0/defaultBucketSize {
+			t.Fatalf("expected a tiny filter to be usable for %d items", count)
+		}
 	}
 
-	filter = f
-}
+	if f, err := NewFilterWithBucketSize(0, 4); err != nil || f.totalBuckets != 1 {
+		t.Fatalf("expected a single bucket but got %v", err)
+	}
 
-func BenchmarkInsert(b *testing.B) {
-	var ok bool
-	filter := StdFilter()
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		ok = filter.Insert([]byte(fmt.Sprintf("item-%d", i%50000)))
+	if _, err := NewFilterWithBucketSize(100, 0); err == nil {
+		t.Fatalf("expected error for 0 bucket size")
 	}
 
-	okay = ok
+	if lf := (&Filter{}).LoadFactor(); lf != 0 {
+		t.Fatalf("expected 0 load factor without slots but got %v", lf)
+	}
 }
 
-func BenchmarkInsertUnique(b *testing.B) {
-	var ok bool
-	filter := StdFilter()
-	fd, _ := os.Open("/usr/share/dict/words")
-	defer fd.Close()
-
-	scanner := bufio.NewScanner(fd)
-	var wordCount int
-	var totalWords int
-	var values [][]byte
-	for scanner.Scan() {
-		word := []byte(scanner.Text())
-		totalWords++
+func TestNewFilterFromBuckets(t *testing.T) {
+	data := make([]uint16, 4*64)
+	f, err := NewFilterFromBuckets(data, make([]uint16, 64), 4, 64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-		if filter.Insert(word) {
-			wordCount++
+	f.Insert([]byte("hello"))
+	f.Insert([]byte("world"))
+	var stored int
+	for _, fp := range data {
+		if fp != 0 {
+			stored++
 		}
-		values = append(values, word)
-	}
-	b.ReportAllocs()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		ok = filter.InsertUnique(values[i%totalWords])
 	}
 
-	okay = ok
-}
+	if stored != 2 {
+		t.Fatalf("expected inserts to write through to data")
+	}
+
+	// a deleted fingerprint stays in data but not in the occupancy
+	f.Delete([]byte("world"))
+	rf, err := NewFilterFromBuckets(data, f.Occupancy(), 4, 64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rf.Count() != 1 || !rf.Lookup([]byte("hello")) || rf.Lookup([]byte("world")) {
+		t.Fatalf("expected filter rebuilt from data to hold only the item left")
+	}
+
+	// a fingerprint of 0 loads like any other
+	zero := make([]uint16, 4*64)
+	occupancy := make([]uint16, 64)
+	occupancy[5] = 1
+	zf, err := NewFilterFromBuckets(zero, occupancy, 4, 64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if zf.Count() != 1 || !reflect.DeepEqual(zf.FindFingerprint(0), []uint32{5}) {
+		t.Fatalf("expected fingerprint 0 in bucket 5 but got %d in %v", zf.Count(), zf.FindFingerprint(0))
+	}
+
+	for _, c := range []struct {
+		data, occupancy []uint16
+		bs              uint8
+		tb              uint32
+	}{
+		{data: data, occupancy: occupancy, bs: 4, tb: 32},
+		{data: data, occupancy: occupancy, bs: 0, tb: 64},
+		{data: data[:12], occupancy: occupancy[:3], bs: 4, tb: 3},
+		{data: data, occupancy: occupancy[:32], bs: 4, tb: 64},
+		{data: data, occupancy: append(make([]uint16, 63), 1<<4), bs: 4, tb: 64},
+	} {
+		if _, err := NewFilterFromBuckets(c.data, c.occupancy, c.bs, c.tb); err == nil {
+			t.Fatalf("expected error for %d buckets of %d over %d fingerprints and %d bitmaps",
+				c.tb, c.bs, len(c.data), len(c.occupancy))
+		}
+	}
+}
+
+func TestFilter_Items(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for _, s := range []string{"hello", "hello", "world"} {
+		f.Insert([]byte(s))
+	}
+
+	items := f.Items()
+	var total int
+	for _, n := range items {
+		total += n
+	}
+
+	if len(items) != 2 || total != 3 {
+		t.Fatalf("expected 2 distinct fingerprints and 3 in total but got %v", items)
+	}
+}
+
+func TestFilter_ForEach(t *testing.T) {
+	f := NewFilter(1 << 12)
+	var items [][]byte
+	for i := 0; i < 2000; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		f.Insert(x)
+		items = append(items, x)
+	}
+
+	type slot struct {
+		bucket uint32
+		fp     Fingerprint
+	}
+
+	slots := make(map[slot]int)
+	var calls uint32
+	f.ForEach(func(bucketIndex uint32, fp Fingerprint) {
+		slots[slot{bucketIndex, fp}]++
+		calls++
+	})
+
+	if calls != f.Count() {
+		t.Fatalf("expected %d calls but got %d", f.Count(), calls)
+	}
+
+	for _, x := range items {
+		fp, i1, i2 := locate(f, x)
+		if slots[slot{i1, Fingerprint(fp)}] == 0 && slots[slot{i2, Fingerprint(fp)}] == 0 {
+			t.Fatalf("expected the fingerprint of %s in one of its buckets", x)
+		}
+	}
+
+	NewFilter(1 << 10).ForEach(func(uint32, Fingerprint) {
+		t.Fatalf("expected no calls for an empty filter")
+	})
+}
+
+func TestFilter_ConcurrentLookup(t *testing.T) {
+	f := StdFilter()
+	var items [][]byte
+	for i := 0; i < 100; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		f.Insert(x)
+		items = append(items, x)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for g := 0; g < 100; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				x := items[(g+i)%len(items)]
+				if !f.Lookup(x) {
+					errs <- string(x)
+					return
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+	close(errs)
+	for x := range errs {
+		t.Fatalf("lookup failed: %s", x)
+	}
+}
+
+func TestFilter_CountNonBlocking(t *testing.T) {
+	f, _ := NewWithOptions(WithCapacity(1<<16), WithFailureWindow(100))
+	items := make([][]byte, 1<<15)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	// hold the write lock the way a long batch insert does
+	f.L.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Count()
+		f.LoadFactor()
+		f.Stats()
+		f.SaturationScore()
+		f.RecentFailureRate()
+		f.Capacity()
+		f.FalsePositiveRate()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the counters to be read without the lock")
+	}
+	f.L.Unlock()
+
+	// poll while the filter is written and its buckets grow
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		f.InsertAll(items)
+		f.GrowBuckets(16)
+	}()
+
+	for polling := true; polling; {
+		select {
+		case <-written:
+			polling = false
+		default:
+		}
+
+		if lf := f.LoadFactor(); lf < 0 || lf > 1 {
+			t.Fatalf("unexpected load factor %v", lf)
+		}
+
+		if r, fpr := f.RecentFailureRate(), f.FalsePositiveRate(); r < 0 || r > 1 || fpr < 0 || fpr > 1 || f.Capacity() == 0 {
+			t.Fatalf("unexpected failure rate %v, false positive rate %v or capacity %d", r, fpr, f.Capacity())
+		}
+	}
+
+	if f.Count() != uint32(len(items)) || f.LoadFactor() != float64(len(items))/float64(16*f.totalBuckets) {
+		t.Fatalf("expected %d items at bucket size 16 but got %d at %v", len(items), f.Count(), f.LoadFactor())
+	}
+}
+
+func TestFilter_InsertUniqueConcurrent(t *testing.T) {
+	f := NewFilter(1 << 12)
+	x := []byte("gopher")
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if !f.InsertUnique(x) {
+					t.Errorf("expected a unique insert to succeed")
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	if f.Count() != 1 || f.CountOf(x) != 1 {
+		t.Fatalf("expected the item once but got %d copies", f.CountOf(x))
+	}
+}
+
+func TestFilter_ConcurrentFilters(t *testing.T) {
+	// the second filter shares the hasher pool of the first, as filters
+	// derived from one another do
+	a := NewFilter(4000)
+	filters := []*Filter{a, NewFilter(4000), newFilterLike(a, a.totalBuckets, a.bucketSize)}
+
+	// fill past where kicking starts, so evictions hash concurrently too
+	var wg sync.WaitGroup
+	for n, f := range filters {
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(n, g int, f *Filter) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					x := []byte(fmt.Sprintf("filter-%d-item-%d-%d", n, g, i))
+					f.Insert(x)
+					f.Lookup(x)
+				}
+			}(n, g, f)
+		}
+	}
+
+	wg.Wait()
+	for n, f := range filters {
+		st := f.Stats()
+		if st.Kicks == 0 || st.Inserts != uint64(f.Count()) {
+			t.Fatalf("filter %d: expected kicking inserts to all be counted but got %+v for %d items", n, st, f.Count())
+		}
+
+		for g := 0; g < 4; g++ {
+			for i := 0; i < 1000; i++ {
+				x := []byte(fmt.Sprintf("filter-%d-item-%d-%d", n, g, i))
+				if ok := f.Lookup(x); !ok && st.Failures == 0 {
+					t.Fatalf("filter %d: lookup failed: %s", n, x)
+				}
+			}
+		}
+	}
+}
+
+func TestFilter_LookupConfidence(t *testing.T) {
+	f := NewFilter(1 << 10)
+	x := []byte("hello")
+	if found, c := f.LookupConfidence(x); found || c != 1 {
+		t.Fatalf("expected a certain miss but got %t %v", found, c)
+	}
+
+	f.Insert(x)
+	found, alone := f.LookupConfidence(x)
+	if q := math.Exp2(-fingerprintBits); !found || alone != 1/(1+q) {
+		t.Fatalf("expected a hit of confidence %v but got %t %v", 1/(1+q), found, alone)
+	}
+
+	// other fingerprints in the item's buckets lower it
+	_, i1, i2 := locate(f, x)
+	for i := 0; f.UBucketLoad(i1)+f.UBucketLoad(i2) < 8; i++ {
+		y := []byte(fmt.Sprintf("item-%d", i))
+		if _, j1, j2 := locate(f, y); j1 == i1 || j1 == i2 || j2 == i1 || j2 == i2 {
+			f.Insert(y)
+		}
+	}
+
+	_, crowded := f.LookupConfidence(x)
+	if crowded >= alone {
+		t.Fatalf("expected fuller buckets to lower confidence below %v but got %v", alone, crowded)
+	}
+
+	// and more copies of it raise it
+	f.Insert(x)
+	if _, copies := f.LookupConfidence(x); copies <= crowded {
+		t.Fatalf("expected another copy to raise confidence above %v but got %v", crowded, copies)
+	}
+}
+
+func TestFilter_StateHash(t *testing.T) {
+	a, b := NewFilter(1<<10), NewFilter(1<<10)
+	for i := 0; i < 500; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		a.Insert(x)
+		b.Insert(x)
+	}
+
+	if a.StateHash() != b.StateHash() {
+		t.Fatalf("expected filters with the same contents to hash the same")
+	}
+
+	// move a fingerprint to another free slot of its bucket
+	bk := &b.buckets[0]
+	from, to := uint8(0), uint8(0)
+	for i := uint8(0); i < b.bucketSize; i++ {
+		if isSet(bk.Track, i) {
+			from = i
+		} else {
+			to = i
+		}
+	}
+
+	bk.FPs[to], bk.Track = bk.FPs[from], set(unSet(bk.Track, from), to)
+	if a.StateHash() != b.StateHash() {
+		t.Fatalf("expected slot order not to change the hash")
+	}
+
+	b.Delete([]byte("item-1"))
+	if a.StateHash() == b.StateHash() {
+		t.Fatalf("expected different contents to hash differently")
+	}
+
+	if NewFilter(1<<10).StateHash() == NewFilter(1<<11).StateHash() {
+		t.Fatalf("expected different geometry to hash differently")
+	}
+}
+
+func TestFilter_SampleFingerprints(t *testing.T) {
+	f := NewFilter(1 << 12)
+	for i := 0; i < 1000; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	items := f.Items()
+	sample := f.SampleFingerprints(100)
+	if len(sample) != 100 {
+		t.Fatalf("expected 100 fingerprints but got %d", len(sample))
+	}
+
+	for _, fp := range sample {
+		if items[fp] == 0 {
+			t.Fatalf("sampled fingerprint %d isn't stored", fp)
+		}
+	}
+
+	if n := len(f.SampleFingerprints(2000)); n != int(f.Count()) {
+		t.Fatalf("expected all %d fingerprints but got %d", f.Count(), n)
+	}
+}
+
+func TestFilter_Swap(t *testing.T) {
+	active, standby := NewFilter(1<<10), NewFilter(1<<10)
+	active.Insert([]byte("old"))
+	for _, s := range []string{"new", "newer"} {
+		standby.Insert([]byte(s))
+	}
+
+	if err := active.Swap(standby); err != nil {
+		t.Fatalf("unexpected error while swapping: %v", err)
+	}
+
+	if active.Count() != 2 || standby.Count() != 1 {
+		t.Fatalf("expected counts 2 and 1 but got %d and %d", active.Count(), standby.Count())
+	}
+
+	if !active.Lookup([]byte("new")) || active.Lookup([]byte("old")) {
+		t.Fatalf("active filter doesn't hold standby contents")
+	}
+
+	if !standby.Lookup([]byte("old")) {
+		t.Fatalf("standby filter doesn't hold active contents")
+	}
+
+	if err := active.Swap(NewFilter(1 << 12)); err == nil {
+		t.Fatalf("expected error swapping filters of different geometry")
+	}
+
+	// spilled items move with the fingerprints
+	spilled, _ := NewWithOptions(WithCapacity(60), WithOverflowBloom(1000))
+	empty, _ := NewWithOptions(WithCapacity(60), WithOverflowBloom(1000))
+	var last []byte
+	for i := 0; spilled.Count() == uint32(i); i++ {
+		last = []byte(fmt.Sprintf("item-%d", i))
+		spilled.Insert(last)
+	}
+
+	if err := empty.Swap(spilled); err != nil {
+		t.Fatalf("unexpected error while swapping: %v", err)
+	}
+
+	if !empty.Lookup(last) || spilled.Lookup(last) {
+		t.Fatalf("expected the spilled item to move with the swap")
+	}
+
+	if err := empty.Swap(NewFilter(60)); err == nil {
+		t.Fatalf("expected error swapping filters with different overflow bloom filters")
+	}
+}
+
+func TestFilter_EncodeDecodeSparse(t *testing.T) {
+	f := NewFilter(1 << 12)
+	data := []string{"hello", "hello, World", "This Worked"}
+	for _, s := range data {
+		f.Insert([]byte(s))
+	}
+
+	var b bytes.Buffer
+	err := f.Encode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	// a dense encoding needs at least a byte per slot
+	if b.Len() >= int(f.bucketSize)*int(f.totalBuckets) {
+		t.Fatalf("expected sparse encoding but got %d bytes", b.Len())
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	if !reflect.DeepEqual(f.buckets, df.buckets) {
+		t.Fatalf("buckets mismatch")
+	}
+
+	for _, s := range data {
+		if !df.Lookup([]byte(s)) {
+			t.Fatalf("lookup failed: %s", s)
+		}
+	}
+}
+
+func TestFilter_EncodeDecodeDense(t *testing.T) {
+	f := NewFilter(1 << 8)
+	for i := 0; i < 128; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	var b bytes.Buffer
+	err := f.Encode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	if !reflect.DeepEqual(f.buckets, df.buckets) {
+		t.Fatalf("buckets mismatch")
+	}
+
+	if df.Count() != f.Count() {
+		t.Fatalf("expected %d count but got %d", f.Count(), df.Count())
+	}
+}
+
+func Test_nextPowerOf2(t *testing.T) {
+	tests := []struct {
+		v uint32
+		e uint32
+	}{
+		{
+			v: 0,
+			e: 1,
+		},
+
+		{
+			v: 1,
+			e: 1,
+		},
+
+		{
+			v: 2,
+			e: 2,
+		},
+
+		{
+			v: 3,
+			e: 4,
+		},
+
+		{
+			v: 4,
+			e: 4,
+		},
+
+		{
+			v: 100,
+			e: 128,
+		},
+
+		{
+			v: 1 << 20,
+			e: 1 << 20,
+		},
+
+		{
+			v: 1<<20 + 1,
+			e: 1 << 21,
+		},
+
+		{
+			v: 1<<31 - 1,
+			e: 1 << 31,
+		},
+
+		{
+			v: 1 << 31,
+			e: 1 << 31,
+		},
+
+		{
+			v: 1<<31 + 1,
+			e: 1 << 31,
+		},
+
+		{
+			v: math.MaxUint32,
+			e: 1 << 31,
+		},
+	}
+
+	for _, c := range tests {
+		g := nextPowerOf2(c.v)
+		if g != c.e {
+			t.Fatalf("%d: expected %d but got %d", c.v, c.e, g)
+		}
+	}
+
+	// tiny counts get a single bucket and huge ones saturate
+	for _, c := range []struct{ count, buckets uint32 }{{0, 1}, {1, 1}, {defaultBucketSize - 1, 1}, {safeItems(maxSlots, defaultBucketSize), 1 << 28}} {
+		if b, _ := bucketsFor(c.count, defaultBucketSize); b != c.buckets {
+			t.Fatalf("%d: expected %d buckets but got %d", c.count, c.buckets, b)
+		}
+	}
+
+	if _, err := bucketsFor(math.MaxUint32, defaultBucketSize); !errors.Is(err, ErrCapacityTooTight) {
+		t.Fatalf("expected %v but got %v", ErrCapacityTooTight, err)
+	}
+
+	if f := NewFilter(0); f.totalBuckets != 1 || !f.Insert([]byte("gopher")) {
+		t.Fatalf("expected a usable filter of 1 bucket but got %d", f.totalBuckets)
+	}
+}
+
+func TestFilter_IsPowerOfTwo(t *testing.T) {
+	tests := []struct {
+		tb uint32
+		e  bool
+	}{
+		{tb: 1, e: true},
+		{tb: 3, e: false},
+		{tb: 64, e: true},
+		{tb: 100, e: false},
+	}
+
+	for _, c := range tests {
+		f := newFilter(c.tb, 4, hasherPool(defaultHash))
+		if g := f.IsPowerOfTwo(); g != c.e {
+			t.Fatalf("expected %t for %d buckets but got %t", c.e, c.tb, g)
+		}
+	}
+
+	if !NewFilter(1000).IsPowerOfTwo() {
+		t.Fatalf("expected NewFilter to size buckets by a power of 2")
+	}
+}
+
+func TestFilter_GetAndInsert(t *testing.T) {
+	f := NewFilter(1 << 12)
+	items := make([][]byte, 1000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	// of the goroutines racing on an item exactly one finds it absent
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	absent := make(map[string]int)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, x := range items {
+				ok, err := f.GetAndInsert(x)
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+					return
+				}
+
+				if !ok {
+					mu.Lock()
+					absent[string(x)]++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for x, n := range absent {
+		if n != 1 {
+			t.Fatalf("%s: expected one caller to find it absent but got %d", x, n)
+		}
+	}
+
+	// an item colliding with an earlier one reads as present and isn't inserted
+	if f.Count() != uint32(len(absent)) {
+		t.Fatalf("expected %d items but got %d", len(absent), f.Count())
+	}
+
+	if _, err := f.GetAndInsert(nil); err != ErrInvalidInput {
+		t.Fatalf("expected %v but got %v", ErrInvalidInput, err)
+	}
+
+	full := NewFilter(1 << 4)
+	var err error
+	for i := 0; err == nil; i++ {
+		_, err = full.GetAndInsert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	if err != ErrFilterFull {
+		t.Fatalf("expected %v but got %v", ErrFilterFull, err)
+	}
+}
+
+func TestFilter_InsertTraced(t *testing.T) {
+	f := NewFilter(1 << 10)
+	var total, failed int
+	for i := 0; i < 2000; i++ {
+		ok, kicks := f.InsertTraced([]byte(fmt.Sprintf("item-%d", i)))
+		if !ok {
+			failed++
+		}
+
+		total += kicks
+	}
+
+	st := f.Stats()
+	if total == 0 || uint64(total) != st.Kicks || uint64(failed) != st.Failures {
+		t.Fatalf("expected %d kicks and %d failures but got %d and %d", st.Kicks, st.Failures, total, failed)
+	}
+
+	if ok, kicks := f.InsertTraced(nil); ok || kicks != 0 {
+		t.Fatalf("expected invalid input to fail without kicks")
+	}
+}
+
+func TestFilter_SnapshotIterator(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for i := 0; i < 500; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	counts := make(map[Fingerprint]int)
+	for _, b := range f.buckets {
+		for _, fp := range occupied(b, f.bucketSize) {
+			counts[fp]++
+		}
+	}
+
+	next := f.SnapshotIterator()
+
+	// writers aren't blocked by the iteration and don't change it
+	for i := 0; i < 500; i++ {
+		f.Delete([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	var n int
+	for fp, ok := next(); ok; fp, ok = next() {
+		counts[fp]--
+		n++
+	}
+
+	if n != 500 {
+		t.Fatalf("expected 500 fingerprints but got %d", n)
+	}
+
+	for fp, c := range counts {
+		if c != 0 {
+			t.Fatalf("fingerprint %d off by %d", fp, c)
+		}
+	}
+
+	if _, ok := next(); ok {
+		t.Fatalf("expected exhausted iterator to stay exhausted")
+	}
+}
+
+func TestFilter_DeleteAt(t *testing.T) {
+	f := NewFilter(1 << 10)
+	x := []byte("item")
+	f.Insert(x)
+	_, i1, i2 := locate(f, x)
+	bucket := i1
+	if f.buckets[i1].Track == 0 {
+		bucket = i2
+	}
+
+	slot := bits.TrailingZeros16(f.buckets[bucket].Track)
+	tests := []struct {
+		bucket uint32
+		slot   int
+		ok     bool
+	}{
+		{f.totalBuckets, 0, false},
+		{bucket, -1, false},
+		{bucket, int(f.bucketSize), false},
+		{bucket, slot, true},
+		{bucket, slot, false},
+	}
+
+	for _, c := range tests {
+		if ok := f.DeleteAt(c.bucket, c.slot); ok != c.ok {
+			t.Fatalf("slot %d of bucket %d: expected %t but got %t", c.slot, c.bucket, c.ok, ok)
+		}
+	}
+
+	if f.Lookup(x) || f.Count() != 0 {
+		t.Fatalf("expected the item to be gone")
+	}
+
+	f.Close()
+	if f.DeleteAt(bucket, slot) || f.BucketLoad(bucket) != -1 {
+		t.Fatalf("expected a closed filter to have no buckets")
+	}
+}
+
+func TestFilter_WouldCollide(t *testing.T) {
+	// with few buckets a colliding item is only a fingerprint match away
+	f := NewFilter(1 << 4)
+	a := []byte("item-0")
+	var b []byte
+	for i := 1; b == nil; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		if f.WouldCollide(a, x) {
+			b = x
+		}
+	}
+
+	f.Insert(a)
+	if !f.Lookup(b) {
+		t.Fatalf("expected %s to be a false positive of %s", b, a)
+	}
+
+	if !f.WouldCollide(a, a) || f.WouldCollide(a, nil) || f.WouldCollide(a, []byte("other")) != f.Lookup([]byte("other")) {
+		t.Fatalf("unexpected collisions")
+	}
+}
+
+// fillTo inserts synthetic keys drawn from the rand source of the filter till
+// it reaches loadFactor, or an insert fails short of it. Filters without a
+// source draw their keys from a fixed seed so benchmarks insert the same keys
+func (f *Filter) fillTo(loadFactor float64) {
+	rnd := f.rnd
+	if rnd == nil {
+		rnd = rand.New(rand.NewSource(1))
+	}
+
+	var x [8]byte
+	for f.LoadFactor() < loadFactor {
+		binary.BigEndian.PutUint64(x[:], rnd.Uint64())
+		if !f.Insert(x[:]) {
+			return
+		}
+	}
+}
+
+func TestFilter_fillTo(t *testing.T) {
+	// kicks draw from the source too, so both filters need their own
+	a, _ := NewWithOptions(WithCapacity(1<<12), WithRandSource(rand.NewSource(1)))
+	b, _ := NewWithOptions(WithCapacity(1<<12), WithRandSource(rand.NewSource(1)))
+	a.fillTo(0.9)
+	b.fillTo(0.9)
+	if lf := a.LoadFactor(); lf < 0.9 || lf > 0.91 {
+		t.Fatalf("expected a load factor of 0.9 but got %0.4f", lf)
+	}
+
+	if a.StateHash() != b.StateHash() {
+		t.Fatalf("expected the same keys to fill both filters the same")
+	}
+}
+
+// Benchmark tests taken from https://github.com/mtchavez/cuckoo
+var filter *Filter
+var okay bool
+
+func BenchmarkCuckooNew(b *testing.B) {
+	b.ReportAllocs()
+	var f *Filter
+	for i := 0; i < b.N; i++ {
+		f = StdFilter()
+	}
+
+	filter = f
+}
+
+func BenchmarkInsert(b *testing.B) {
+	var ok bool
+	filter := StdFilter()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ok = filter.Insert([]byte(fmt.Sprintf("item-%d", i%50000)))
+	}
+
+	okay = ok
+}
+
+func BenchmarkInsertUnique(b *testing.B) {
+	var ok bool
+	filter := StdFilter()
+	fd, _ := os.Open("/usr/share/dict/words")
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	var wordCount int
+	var totalWords int
+	var values [][]byte
+	for scanner.Scan() {
+		word := []byte(scanner.Text())
+		totalWords++
+
+		if filter.Insert(word) {
+			wordCount++
+		}
+		values = append(values, word)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ok = filter.InsertUnique(values[i%totalWords])
+	}
+
+	okay = ok
+}
+
+func BenchmarkInsertUniqueDuplicates(b *testing.B) {
+	var ok bool
+	filter := NewFilter(1 << 20)
+	values := make([][]byte, 1000)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ok = filter.InsertUnique(values[i%len(values)])
+	}
+
+	okay = ok
+}
 
 func BenchmarkLookup(b *testing.B) {
 	var ok bool
@@ -386,3 +1733,223 @@ func BenchmarkDelete(b *testing.B) {
 
 	okay = ok
 }
+
+func BenchmarkInsertLoaded(b *testing.B) {
+	var ok bool
+	filter := NewFilter(1 << 20)
+	filter.fillTo(0.9)
+	values := make([][]byte, 1<<10)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x := values[i%len(values)]
+		ok = filter.Insert(x)
+		filter.Delete(x)
+	}
+
+	okay = ok
+}
+
+func BenchmarkLookupLoaded(b *testing.B) {
+	var ok bool
+	filter := NewFilter(1 << 20)
+	filter.fillTo(0.9)
+	values := make([][]byte, 1<<10)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ok = filter.Lookup(values[i%len(values)])
+	}
+
+	okay = ok
+}
+
+func BenchmarkIndicesOf(b *testing.B) {
+	const tb = 1 << 20
+	for _, c := range []struct {
+		name string
+		mask uint32
+	}{
+		{name: "mask", mask: bucketMask(tb)},
+		{name: "modulo", mask: 0},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			var sum uint32
+			for i := 0; i < b.N; i++ {
+				i1, i2 := indicesOf(StandardIndexing, uint32(i)*0x9e3779b9, uint32(i), tb, c.mask)
+				sum += i1 ^ i2
+			}
+
+			okay = sum == 0
+		})
+	}
+}
+
+func BenchmarkReset(b *testing.B) {
+	b.Run("reset", func(b *testing.B) {
+		f := NewFilter(1 << 20)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f.Reset()
+		}
+
+		filter = f
+	})
+
+	b.Run("new", func(b *testing.B) {
+		var f *Filter
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f = NewFilter(1 << 20)
+		}
+
+		filter = f
+	})
+}
+
+func BenchmarkInsertMany(b *testing.B) {
+	values := make([][]byte, 1<<10)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	b.Run("many", func(b *testing.B) {
+		f := NewFilter(1 << 12)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f.Reset()
+			f.InsertMany(values)
+		}
+	})
+
+	b.Run("each", func(b *testing.B) {
+		f := NewFilter(1 << 12)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			f.Reset()
+			for _, x := range values {
+				f.Insert(x)
+			}
+		}
+	})
+}
+
+func BenchmarkLookupMany(b *testing.B) {
+	filter := NewFilter(1 << 20)
+	filter.fillTo(0.9)
+	values := make([][]byte, 1<<10)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	b.Run("many", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				filter.LookupMany(values)
+			}
+		})
+	})
+
+	b.Run("each", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for _, x := range values {
+					filter.Lookup(x)
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkParallel runs lookups with an insert and delete every 8 of them
+// from every GOMAXPROCS goroutine, comparing a Filter behind its single lock
+// with ShardedFilters of the same capacity. Run it with -cpu to see the
+// shards scale with the goroutines
+func BenchmarkParallel(b *testing.B) {
+	type set interface {
+		Insert([]byte) bool
+		Lookup([]byte) bool
+		Delete([]byte) bool
+	}
+
+	filters := []struct {
+		name string
+		new  func() set
+	}{
+		{"single lock", func() set { return NewFilter(1 << 20) }},
+		{"sharded 4", func() set { s, _ := NewShardedFilter(4, WithCapacity(1<<20)); return s }},
+		{"sharded 16", func() set { s, _ := NewShardedFilter(16, WithCapacity(1<<20)); return s }},
+	}
+
+	values := make([][]byte, 1<<10)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	for _, c := range filters {
+		f := c.new()
+		for i := 0; i < 1<<19; i++ {
+			f.Insert([]byte(fmt.Sprintf("fill-%d", i)))
+		}
+
+		b.Run(c.name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					x := values[i%len(values)]
+					if i%8 == 0 {
+						f.Insert(x)
+						f.Delete(x)
+						continue
+					}
+
+					f.Lookup(x)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMissing(b *testing.B) {
+	filter := NewFilter(1 << 20)
+	filter.fillTo(0.9)
+	values := make([][]byte, 1<<10)
+	for i := range values {
+		values[i] = []byte(fmt.Sprintf("item-%d", i))
+	}
+
+	b.Run("batch", func(b *testing.B) {
+		var n int
+		for i := 0; i < b.N; i++ {
+			n += len(filter.Missing(values))
+		}
+
+		okay = n == 0
+	})
+
+	// Missing as one lookup after the other
+	b.Run("loop", func(b *testing.B) {
+		var n int
+		for i := 0; i < b.N; i++ {
+			var missing [][]byte
+			filter.L.RLock()
+			for _, x := range values {
+				if !filter.ULookup(x) {
+					missing = append(missing, x)
+				}
+			}
+			filter.L.RUnlock()
+			n += len(missing)
+		}
+
+		okay = n == 0
+	})
+}
@@ -0,0 +1,78 @@
+package cuckoo
+
+// locateHashed returns the fingerprint and candidate buckets of a 128 bit
+// hash hi:lo. The first bucket is the low 32 bits of lo modulo the bucket
+// count and the fingerprint is the high 16 bits of hi, so the two don't share
+// bits. The alternate bucket is found from the fingerprint as usual, which
+// kicking relies on, hashing only its two bytes
+func locateHashed(f *Filter, hi, lo uint64) (fp fingerprint, i1, i2 uint32) {
+	fp = fingerprint(hi >> 48)
+	i1, i2 = indicesOf(f.indexing, uint32(lo), altHash(f, fp), f.totalBuckets, f.mask)
+	return fp, i1, i2
+}
+
+// InsertHashed inserts an item by its 128 bit hash hi:lo, for callers whose
+// keys already are strong hashes, without hashing them again. Hashed items
+// are placed apart from those of Insert, so look them up with LookupHashed.
+// Items that don't fit aren't spilled to the overflow bloom filter
+func (f *Filter) InsertHashed(hi, lo uint64) bool {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertHashed(hi, lo)
+}
+
+// UInsertHashed inserts an item by its 128 bit hash. Not thread safe
+func (f *Filter) UInsertHashed(hi, lo uint64) bool {
+	if f.closed {
+		return false
+	}
+
+	fp, i1, i2 := locateHashed(f, hi, lo)
+	return insertAt(f, fp, i1, i2) == nil
+}
+
+// LookupHashed checks if an item was inserted by its 128 bit hash hi:lo
+func (f *Filter) LookupHashed(hi, lo uint64) bool {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.ULookupHashed(hi, lo)
+}
+
+// ULookupHashed checks if an item was inserted by its 128 bit hash. Not thread safe
+func (f *Filter) ULookupHashed(hi, lo uint64) bool {
+	if f.closed {
+		return false
+	}
+
+	fp, i1, i2 := locateHashed(f, hi, lo)
+	return containsIn(f.buckets[i1], f.bucketSize, fp) || containsIn(f.buckets[i2], f.bucketSize, fp)
+}
+
+// DeleteHashed deletes an item inserted by its 128 bit hash hi:lo
+func (f *Filter) DeleteHashed(hi, lo uint64) bool {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UDeleteHashed(hi, lo)
+}
+
+// UDeleteHashed deletes an item inserted by its 128 bit hash. Not thread safe
+func (f *Filter) UDeleteHashed(hi, lo uint64) bool {
+	if f.closed {
+		return false
+	}
+
+	fp, i1, i2 := locateHashed(f, hi, lo)
+	if dropRef(f, fp, i1, i2) {
+		return true
+	}
+
+	if !deleteFrom(&f.buckets[i1], f.bucketSize, fp) && !deleteFrom(&f.buckets[i2], f.bucketSize, fp) {
+		return false
+	}
+
+	dropCount(f, 1)
+	return true
+}
@@ -0,0 +1,45 @@
+package cuckoo
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestFilter_InsertHashed(t *testing.T) {
+	f := NewFilter(1 << 12)
+	rnd := rand.New(rand.NewSource(1))
+	keys := make([][2]uint64, 3000)
+	for i := range keys {
+		keys[i] = [2]uint64{rnd.Uint64(), rnd.Uint64()}
+		if !f.InsertHashed(keys[i][0], keys[i][1]) {
+			t.Fatalf("unexpected insert failure at load %0.4f", f.LoadFactor())
+		}
+	}
+
+	for _, k := range keys {
+		if !f.LookupHashed(k[0], k[1]) {
+			t.Fatalf("lookup failed: %x", k)
+		}
+	}
+
+	var fps int
+	for i := 0; i < 10000; i++ {
+		if f.LookupHashed(rnd.Uint64(), rnd.Uint64()) {
+			fps++
+		}
+	}
+
+	if fps > 100 {
+		t.Fatalf("expected few false positives but got %d in 10000", fps)
+	}
+
+	for _, k := range keys {
+		if !f.DeleteHashed(k[0], k[1]) {
+			t.Fatalf("delete failed: %x", k)
+		}
+	}
+
+	if f.Count() != 0 || f.DeleteHashed(keys[0][0], keys[0][1]) {
+		t.Fatalf("expected every hashed item deleted but %d are left", f.Count())
+	}
+}
@@ -0,0 +1,277 @@
+package cuckoo
+
+import (
+	"fmt"
+	"slices"
+	"unsafe"
+)
+
+// MergeMode is how MergeMultiset combines the copies of a fingerprint held by both filters
+type MergeMode uint8
+
+const (
+	// MergeSum keeps the copies of both filters
+	MergeSum MergeMode = iota
+
+	// MergeMax keeps the copies of whichever filter holds more
+	MergeMax
+)
+
+// pairKey is a fingerprint and the lower of the two buckets it can live in
+type pairKey struct {
+	lo uint32
+	fp fingerprint
+}
+
+// pairCounts returns the copies of every fingerprint in src per bucket pair,
+// and the pairs in the order of their first slot in src. Alternate buckets are
+// computed with f's hash, which must match src's seed
+func pairCounts(f, src *Filter) (map[pairKey]int, []pairKey) {
+	counts := make(map[pairKey]int)
+	var keys []pairKey
+	for i, b := range src.buckets {
+		for j := uint8(0); j < src.bucketSize; j++ {
+			if !isSet(b.Track, j) {
+				continue
+			}
+
+			lo := alternateIndex(f.indexing, f.totalBuckets, f.mask, uint32(i), altHash(f, b.FPs[j]))
+			if uint32(i) < lo {
+				lo = uint32(i)
+			}
+
+			k := pairKey{lo: lo, fp: b.FPs[j]}
+			if counts[k] == 0 {
+				keys = append(keys, k)
+			}
+
+			counts[k]++
+		}
+	}
+
+	return counts, keys
+}
+
+// countIn returns the copies of fp in the bucket
+func countIn(b bucket, bs uint8, fp fingerprint) (n int) {
+	for i := uint8(0); i < bs; i++ {
+		if isSet(b.Track, i) && b.FPs[i] == fp {
+			n++
+		}
+	}
+
+	return n
+}
+
+// lockPair write locks w and read locks r ordered by address, like lockBoth.
+// The same filter is locked only once
+func lockPair(w, r *Filter) (unlock func()) {
+	if w == r {
+		w.L.Lock()
+		return w.L.Unlock
+	}
+
+	if uintptr(unsafe.Pointer(w)) < uintptr(unsafe.Pointer(r)) {
+		w.L.Lock()
+		r.L.RLock()
+	} else {
+		r.L.RLock()
+		w.L.Lock()
+	}
+
+	return func() {
+		r.L.RUnlock()
+		w.L.Unlock()
+	}
+}
+
+// mergeOverflow ors the overflow bloom filter of other into f's. Items other
+// spilled are only kept there, so a non-empty one is rejected unless f has an
+// overflow bloom filter of the same size to take it
+func mergeOverflow(f, other *Filter) error {
+	if other.overflow == nil || !slices.ContainsFunc(other.overflow.bits, func(w uint64) bool { return w != 0 }) {
+		return nil
+	}
+
+	if !sameOverflow(f, other) {
+		return fmt.Errorf("can't merge the spilled items of other without an overflow bloom filter of the same size")
+	}
+
+	for i, w := range other.overflow.bits {
+		f.overflow.bits[i] |= w
+	}
+
+	return nil
+}
+
+// MergeMultiset adds the fingerprints of other into f, combining the copies
+// both hold of a fingerprint by mode. Both filters must have the same geometry.
+// Fingerprints are inserted in bucket order with the checks of an insert, so
+// they're referenced under WithDeleteSafety and stop at f's load limits with
+// the error of the insert, ErrFilterFull, ErrSoftCapReached or
+// ErrMaxMultiplicity, with the fingerprints placed till then left in f. Items
+// other spilled to its overflow bloom filter are merged into f's, which must
+// be of the same size
+func (f *Filter) MergeMultiset(other *Filter, mode MergeMode) error {
+	unlock := lockPair(f, other)
+	defer unlock()
+
+	if err := compatible("merge", f, other); err != nil {
+		return err
+	}
+
+	counts, keys := pairCounts(f, other)
+	if err := mergeOverflow(f, other); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		n := counts[k]
+		hi := alternateIndex(f.indexing, f.totalBuckets, f.mask, k.lo, altHash(f, k.fp))
+		if mode == MergeMax {
+			n -= countIn(f.buckets[k.lo], f.bucketSize, k.fp)
+			if hi != k.lo {
+				n -= countIn(f.buckets[hi], f.bucketSize, k.fp)
+			}
+		}
+
+		for ; n > 0; n-- {
+			if err := insertAt(f, k.fp, k.lo, hi); err != nil {
+				return fmt.Errorf("failed to merge fingerprint %d: %w", k.fp, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Merge adds every fingerprint of other into f, like inserting the items of
+// other into f. An item held by both ends up held twice, so it survives a
+// delete from either side, MergeMultiset with MergeMax keeps one. Both filters
+// must have the same geometry and hash items the same way. The errors are
+// those of MergeMultiset
+func (f *Filter) Merge(other *Filter) error {
+	return f.MergeMultiset(other, MergeSum)
+}
+
+// Halve returns a filter of half the buckets holding the fingerprints of f.
+// Bucket i and i + totalBuckets/2 fold into bucket i, which keeps every
+// fingerprint reachable since indices are taken modulo the bucket count.
+// Fingerprints that don't fit their folded buckets are kicked like an insert,
+// and ErrFilterFull is returned if any can't be placed. The halved filter is
+// configured like f except for its victim strategy and eviction hook, which
+// can keep state and aren't shared
+func (f *Filter) Halve() (*Filter, error) {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	if f.closed {
+		return nil, ErrClosed
+	}
+
+	if f.totalBuckets < 2 || !isPowerOf2(f.totalBuckets) {
+		return nil, fmt.Errorf("can't halve %d buckets, must be a power of 2", f.totalBuckets)
+	}
+
+	half := f.totalBuckets / 2
+	nf := newFilterLike(f, half, f.bucketSize)
+	var dropped int
+	for i, b := range f.buckets {
+		for j := uint8(0); j < f.bucketSize; j++ {
+			if !isSet(b.Track, j) {
+				continue
+			}
+
+			i1 := uint32(i) % half
+			i2 := alternateIndex(nf.indexing, half, nf.mask, i1, altHash(nf, b.FPs[j]))
+			if _, err := place(nf, b.FPs[j], i1, i2); err != nil {
+				dropped++
+			}
+		}
+	}
+
+	if dropped > 0 {
+		return nil, fmt.Errorf("%d fingerprints don't fit in %d buckets: %w", dropped, half, ErrFilterFull)
+	}
+
+	return nf, nil
+}
+
+// rlockBoth read locks both filters ordered by address, like lockBoth.
+// The same filter is locked only once
+func rlockBoth(a, b *Filter) (unlock func()) {
+	if a == b {
+		a.L.RLock()
+		return a.L.RUnlock
+	}
+
+	if uintptr(unsafe.Pointer(a)) > uintptr(unsafe.Pointer(b)) {
+		a, b = b, a
+	}
+
+	a.L.RLock()
+	b.L.RLock()
+	return func() {
+		b.L.RUnlock()
+		a.L.RUnlock()
+	}
+}
+
+// UnionCount estimates the distinct items in the union of a and b from their
+// fingerprints. Copies of a fingerprint in the same bucket pair count as the
+// larger of the copies either holds, so items inserted into both count once.
+// Items sharing a fingerprint and buckets count once too, which makes it an
+// underestimate bounded by the false positive rate. Both filters must have
+// the same geometry
+func UnionCount(a, b *Filter) (uint32, error) {
+	unlock := rlockBoth(a, b)
+	defer unlock()
+
+	if err := compatible("count the union of", a, b); err != nil {
+		return 0, err
+	}
+
+	ac, _ := pairCounts(a, a)
+	bc, _ := pairCounts(a, b)
+	var n uint32
+	for k, c := range ac {
+		n += uint32(max(c, bc[k]))
+	}
+
+	for k, c := range bc {
+		if _, ok := ac[k]; !ok {
+			n += uint32(c)
+		}
+	}
+
+	return n, nil
+}
+
+// GrowBuckets widens every bucket to newBucketSize slots in place. Indices
+// don't depend on the bucket size, so every fingerprint stays in its bucket
+// and the filter takes more items at the same bucket count, at the higher
+// false positive rate of the larger buckets. A filter from NewFilterFromBuckets
+// stops sharing its data
+func (f *Filter) GrowBuckets(newBucketSize uint8) error {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	if f.closed {
+		return ErrClosed
+	}
+
+	if newBucketSize <= f.bucketSize || newBucketSize > maxBucketSize {
+		return fmt.Errorf("can't grow buckets of size %d to %d. Max bucket size is %d",
+			f.bucketSize, newBucketSize, maxBucketSize)
+	}
+
+	buckets := initBuckets(f.totalBuckets, newBucketSize)
+	for i, b := range f.buckets {
+		buckets[i].Track = b.Track
+		copy(buckets[i].FPs, b.FPs)
+	}
+
+	f.buckets, f.bucketSize = buckets, newBucketSize
+	setGeometry(f)
+	return nil
+}
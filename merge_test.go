@@ -0,0 +1,356 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestFilter_MergeMultiset(t *testing.T) {
+	tests := []struct {
+		mode  MergeMode
+		count int
+	}{
+		{
+			mode:  MergeSum,
+			count: 5,
+		},
+
+		{
+			mode:  MergeMax,
+			count: 3,
+		},
+	}
+
+	for _, c := range tests {
+		a, b := NewFilter(1<<10), NewFilter(1<<10)
+		for i := 0; i < 2; i++ {
+			a.Insert([]byte("dup"))
+		}
+
+		for i := 0; i < 3; i++ {
+			b.Insert([]byte("dup"))
+		}
+
+		a.Insert([]byte("only a"))
+		b.Insert([]byte("only b"))
+		if err := a.MergeMultiset(b, c.mode); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		fp, _, _ := locate(a, []byte("dup"))
+		if n := a.Items()[Fingerprint(fp)]; n != c.count {
+			t.Fatalf("expected %d copies but got %d", c.count, n)
+		}
+
+		if !a.Lookup([]byte("only a")) || !a.Lookup([]byte("only b")) {
+			t.Fatalf("expected items of both filters")
+		}
+
+		if a.Count() != uint32(c.count+2) {
+			t.Fatalf("expected %d count but got %d", c.count+2, a.Count())
+		}
+	}
+}
+
+func TestFilter_Merge(t *testing.T) {
+	a, b := NewFilter(1<<12), NewFilter(1<<12)
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		x := []byte(fmt.Sprintf("a-%d", i))
+		a.Insert(x)
+		items = append(items, x)
+	}
+
+	for i := 0; i < 1000; i++ {
+		x := []byte(fmt.Sprintf("b-%d", i))
+		b.Insert(x)
+		items = append(items, x)
+	}
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if a.Count() != 2000 {
+		t.Fatalf("expected 2000 count but got %d", a.Count())
+	}
+
+	for _, x := range items {
+		if !a.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	full := NewFilter(1 << 12)
+	for i := 0; full.Insert([]byte(fmt.Sprintf("full-%d", i))); i++ {
+	}
+
+	if err := full.Merge(b); !errors.Is(err, ErrFilterFull) {
+		t.Fatalf("expected %v but got %v", ErrFilterFull, err)
+	}
+
+	seeded, _ := NewWithOptions(WithCapacity(1<<12), WithSeed(7))
+	if err := a.Merge(seeded); err == nil {
+		t.Fatalf("expected error merging filters hashing differently")
+	}
+}
+
+func TestFilter_MergeMultisetErrors(t *testing.T) {
+	if err := NewFilter(1<<10).MergeMultiset(NewFilter(1<<12), MergeSum); err == nil {
+		t.Fatalf("expected error merging filters of different geometry")
+	}
+
+	a, b := NewFilter(60), NewFilter(60)
+	for i := 0; i < 60; i++ {
+		a.Insert([]byte(fmt.Sprintf("a-%d", i)))
+		b.Insert([]byte(fmt.Sprintf("b-%d", i)))
+	}
+
+	if err := a.MergeMultiset(b, MergeSum); !errors.Is(err, ErrFilterFull) {
+		t.Fatalf("expected %v but got %v", ErrFilterFull, err)
+	}
+
+	// merging into itself doesn't deadlock
+	if err := b.MergeMultiset(b, MergeMax); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFilter_MergeOverflow(t *testing.T) {
+	spilled, _ := NewWithOptions(WithCapacity(60), WithOverflowBloom(1000))
+	var items [][]byte
+	for i := 0; i < 200; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		spilled.Insert(x)
+		items = append(items, x)
+	}
+
+	// the spilled items have nowhere to go
+	small, _ := NewWithOptions(WithCapacity(60), WithOverflowBloom(10))
+	for _, f := range []*Filter{NewFilter(60), small} {
+		if err := f.Merge(spilled); err == nil || f.Count() != 0 {
+			t.Fatalf("expected the merge to be rejected with no fingerprints placed but got %v with %d", err, f.Count())
+		}
+	}
+
+	f, _ := NewWithOptions(WithCapacity(60), WithOverflowBloom(1000))
+	if err := f.Merge(spilled); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	// an empty overflow bloom filter needs none to merge into
+	empty, _ := NewWithOptions(WithCapacity(60), WithOverflowBloom(1000))
+	empty.Insert([]byte("gopher"))
+	if err := NewFilter(60).Merge(empty); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFilter_MergeInsertChecks(t *testing.T) {
+	b := NewFilter(1000)
+	for i := 0; i < 500; i++ {
+		b.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	capped, _ := NewWithOptions(WithCapacity(1000), WithSoftCap(0.25))
+	if err := capped.Merge(b); !errors.Is(err, ErrSoftCapReached) || capped.ULoadFactor() > 0.25 {
+		t.Fatalf("expected %v within the soft cap but got %v at %v", ErrSoftCapReached, err, capped.ULoadFactor())
+	}
+
+	// a fingerprint already held is referenced, and takes a delete per copy
+	safe, _ := NewWithOptions(WithCapacity(1000), WithDeleteSafety())
+	x := []byte("gopher")
+	safe.Insert(x)
+	other := NewFilter(1000)
+	other.Insert(x)
+	if err := safe.Merge(other); err != nil || safe.Count() != 1 {
+		t.Fatalf("expected the merged copy to be a reference but got %v with %d", err, safe.Count())
+	}
+
+	if !safe.Delete(x) || !safe.Lookup(x) || !safe.Delete(x) || safe.Lookup(x) {
+		t.Fatalf("expected 2 deletes to remove both copies")
+	}
+}
+
+func TestFilter_MergeOrder(t *testing.T) {
+	b := NewFilter(1000)
+	for i := 0; i < 900; i++ {
+		b.Insert([]byte(fmt.Sprintf("b-%d", i)))
+	}
+
+	var want []bucket
+	for i := 0; i < 5; i++ {
+		a, _ := NewWithOptions(WithCapacity(1000), WithDeterministicPlacement())
+		for j := 0; j < 50; j++ {
+			a.Insert([]byte(fmt.Sprintf("a-%d", j)))
+		}
+
+		if err := a.Merge(b); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if want == nil {
+			want = a.buckets
+		} else if !reflect.DeepEqual(a.buckets, want) {
+			t.Fatalf("expected merges to lay out the same buckets")
+		}
+	}
+}
+
+func TestFilter_Halve(t *testing.T) {
+	f := NewFilter(1 << 12)
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		f.Insert(x)
+		items = append(items, x)
+	}
+
+	hf, err := f.Halve()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if hf.totalBuckets != f.totalBuckets/2 || hf.Count() != f.Count() {
+		t.Fatalf("expected %d buckets with %d count but got %d with %d",
+			f.totalBuckets/2, f.Count(), hf.totalBuckets, hf.Count())
+	}
+
+	for _, x := range items {
+		if !hf.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	// past half load the folded table can't hold everything
+	for i := 1000; f.LoadFactor() < 0.9; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	if _, err := f.Halve(); !errors.Is(err, ErrFilterFull) {
+		t.Fatalf("expected %v but got %v", ErrFilterFull, err)
+	}
+
+	// stateful strategies and hooks stay with the source filter
+	var evicted int
+	f, _ = NewWithOptions(WithCapacity(1<<12), WithVictimStrategy(RoundRobinVictim()),
+		WithEvictionHook(func(uint32, Fingerprint) { evicted++ }))
+	for i := 0; f.LoadFactor() < 0.45; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	before := evicted
+	hf, err = f.Halve()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if hf.victim != nil || hf.evictHook != nil || evicted != before {
+		t.Fatalf("expected the halved filter not to share the strategy and hook")
+	}
+}
+
+func TestUnionCount(t *testing.T) {
+	a, b := NewFilter(1<<12), NewFilter(1<<12)
+	for i := 0; i < 1000; i++ {
+		a.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	for i := 500; i < 1800; i++ {
+		b.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	n, err := UnionCount(a, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n > 1800 || n < 1800*99/100 {
+		t.Fatalf("expected close to 1800 distinct items but got %d", n)
+	}
+
+	if n, _ := UnionCount(a, a); n != a.Count() {
+		t.Fatalf("expected the union with itself to be %d but got %d", a.Count(), n)
+	}
+
+	if _, err := UnionCount(a, NewFilter(1<<10)); err == nil {
+		t.Fatalf("expected error for different geometry")
+	}
+}
+
+func TestFilter_GrowBuckets(t *testing.T) {
+	f, err := NewFilterWithBucketSize(900, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; f.Insert([]byte(fmt.Sprintf("item-%d", i))); i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	count := f.Count()
+	if err := f.GrowBuckets(8); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f.Count() != count || f.bucketSize != 8 {
+		t.Fatalf("expected %d items in buckets of 8 but got %d in buckets of %d", count, f.Count(), f.bucketSize)
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	if !f.Insert([]byte("more")) {
+		t.Fatalf("expected wider buckets to take more items")
+	}
+
+	for _, bs := range []uint8{8, 4, 17} {
+		if err := f.GrowBuckets(bs); err == nil {
+			t.Fatalf("expected error growing buckets to %d", bs)
+		}
+	}
+}
+
+func TestFilter_CompatibleWith(t *testing.T) {
+	with := func(opts ...Option) *Filter {
+		f, err := NewWithOptions(append(opts, WithCapacity(1<<10))...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		return f
+	}
+
+	f := NewFilter(1 << 10)
+	tests := []struct {
+		name  string
+		other *Filter
+		ok    bool
+	}{
+		{"same", NewFilter(1 << 10), true},
+		{"itself", f, true},
+		{"geometry", NewFilter(1 << 12), false},
+		{"seed", with(WithSeed(7)), false},
+		{"order", with(WithByteOrder(binary.LittleEndian)), false},
+		{"indexing", with(WithIndexing(PartialKeyIndexing)), false},
+	}
+
+	for _, c := range tests {
+		if ok := f.CompatibleWith(c.other); ok != c.ok {
+			t.Fatalf("%s: expected %t but got %t", c.name, c.ok, ok)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package cuckoo
+
+// countAt returns the copies of fp in its buckets i1 and i2
+func countAt(f *Filter, fp fingerprint, i1, i2 uint32) int {
+	n := countIn(f.buckets[i1], f.bucketSize, fp)
+	if i2 != i1 {
+		n += countIn(f.buckets[i2], f.bucketSize, fp)
+	}
+
+	return n
+}
+
+// refKey is a fingerprint and the lower of its two buckets. Kicks only move a
+// fingerprint between its buckets, so the key holds wherever it's stored
+type refKey struct {
+	i  uint32
+	fp fingerprint
+}
+
+// refKeyOf returns the reference key of fp in buckets i1 and i2
+func refKeyOf(fp fingerprint, i1, i2 uint32) refKey {
+	return refKey{i: min(i1, i2), fp: fp}
+}
+
+// addRef adds a reference to a stored copy of fp under WithDeleteSafety,
+// returning false if there's none to add to
+func addRef(f *Filter, fp fingerprint, i1, i2 uint32) bool {
+	if f.refs == nil || countAt(f, fp, i1, i2) == 0 {
+		return false
+	}
+
+	f.refs[refKeyOf(fp, i1, i2)]++
+	return true
+}
+
+// dropRef drops a reference to a stored copy of fp, returning false if fp has
+// none and deleting must free its slot
+func dropRef(f *Filter, fp fingerprint, i1, i2 uint32) bool {
+	key := refKeyOf(fp, i1, i2)
+	n := f.refs[key]
+	switch n {
+	case 0:
+		return false
+	case 1:
+		delete(f.refs, key)
+	default:
+		f.refs[key] = n - 1
+	}
+
+	return true
+}
+
+// CountOf returns how many copies of the item's fingerprint the filter holds.
+// Like Lookup it can overcount from other items sharing the fingerprint.
+// Items spilled to the overflow bloom filter aren't counted
+func (f *Filter) CountOf(x []byte) int {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UCountOf(x)
+}
+
+// UCountOf returns how many copies of the item's fingerprint the filter holds. Not thread safe
+func (f *Filter) UCountOf(x []byte) int {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return 0
+	}
+
+	fp, i1, i2 := locate(f, x)
+	return countAt(f, fp, i1, i2) + int(f.refs[refKeyOf(fp, i1, i2)])
+}
+
+// InsertN inserts n copies of the item, returning how many were inserted.
+// It stops at the first copy that doesn't fit, which isn't spilled to the
+// overflow bloom filter since the bloom filter can't count
+func (f *Filter) InsertN(x []byte, n int) int {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UInsertN(x, n)
+}
+
+// UInsertN inserts n copies of the item, returning how many were inserted. Not thread safe
+func (f *Filter) UInsertN(x []byte, n int) int {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return 0
+	}
+
+	fp, i1, i2 := locate(f, x)
+	for i := 0; i < n; i++ {
+		if insertAt(f, fp, i1, i2) != nil {
+			return i
+		}
+	}
+
+	return n
+}
+
+// DeleteAll deletes every copy of the item, returning how many were deleted
+func (f *Filter) DeleteAll(x []byte) int {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	return f.UDeleteAll(x)
+}
+
+// UDeleteAll deletes every copy of the item, returning how many were deleted. Not thread safe
+func (f *Filter) UDeleteAll(x []byte) int {
+	x, err := keyOf(f, x)
+	if err != nil {
+		return 0
+	}
+
+	var n int
+	fp, i1, i2 := locate(f, x)
+	for deleteFrom(&f.buckets[i1], f.bucketSize, fp) || deleteFrom(&f.buckets[i2], f.bucketSize, fp) {
+		n++
+	}
+
+	dropCount(f, uint32(n))
+	key := refKeyOf(fp, i1, i2)
+	n += int(f.refs[key])
+	delete(f.refs, key)
+	return n
+}
+
+// ApproxMultiset counts the copies of items added to it. Counts are
+// approximate the same way lookups are, items sharing a fingerprint and
+// buckets count towards each other. An item can be held at most twice the
+// bucket size times. Use it over a filter as ApproxMultiset{f}
+type ApproxMultiset struct {
+	*Filter
+}
+
+// Add adds another copy of the item, returning false if there's no room for it
+func (m ApproxMultiset) Add(x []byte) bool {
+	return m.InsertN(x, 1) == 1
+}
+
+// Remove removes a copy of the item, returning false if it held none
+func (m ApproxMultiset) Remove(x []byte) bool {
+	return m.Delete(x)
+}
+
+// Count returns the copies of the item held
+func (m ApproxMultiset) Count(x []byte) int {
+	return m.CountOf(x)
+}
@@ -0,0 +1,46 @@
+package cuckoo
+
+import "testing"
+
+func TestFilter_InsertNCountOfDeleteAll(t *testing.T) {
+	f := NewFilter(1 << 10)
+	x := []byte("hello")
+	if n := f.InsertN(x, 5); n != 5 {
+		t.Fatalf("expected 5 copies inserted but got %d", n)
+	}
+
+	// both buckets full of the item's copies
+	if n := f.InsertN(x, 100); n != 2*int(f.bucketSize)-5 {
+		t.Fatalf("expected %d copies inserted but got %d", 2*int(f.bucketSize)-5, n)
+	}
+
+	if n := f.CountOf(x); n != 2*int(f.bucketSize) {
+		t.Fatalf("expected %d copies but got %d", 2*f.bucketSize, n)
+	}
+
+	if n := f.DeleteAll(x); n != 2*int(f.bucketSize) || f.Count() != 0 || f.Lookup(x) {
+		t.Fatalf("expected every copy deleted but deleted %d leaving %d", n, f.Count())
+	}
+
+	if f.InsertN(nil, 1) != 0 || f.CountOf(nil) != 0 || f.DeleteAll(nil) != 0 {
+		t.Fatalf("expected empty items to be rejected")
+	}
+}
+
+func TestApproxMultiset(t *testing.T) {
+	m := ApproxMultiset{NewFilter(1 << 10)}
+	x := []byte("hello")
+	for i := 0; i < 3; i++ {
+		if !m.Add(x) {
+			t.Fatalf("expected add to succeed")
+		}
+	}
+
+	if !m.Remove(x) || m.Count(x) != 2 {
+		t.Fatalf("expected 2 copies but got %d", m.Count(x))
+	}
+
+	if m.Count([]byte("world")) != 0 {
+		t.Fatalf("expected no copies of a missing item")
+	}
+}
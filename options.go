@@ -0,0 +1,553 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Option configures a Filter built by NewWithOptions
+type Option func(o *options) error
+
+// options holds everything NewWithOptions builds the filter from
+type options struct {
+	capacity      uint32
+	bucketSize    uint8
+	maxKicks      uint16
+	newHash       func() hash.Hash32
+	victim        VictimStrategy
+	kickStart     KickStartMode
+	deterministic bool
+	evictHook     func(bucket uint32, fp Fingerprint)
+	transform     func([]byte) []byte
+	seed          uint32
+	lengthPrefix  bool
+	strictKeys    bool
+	order         binary.ByteOrder
+	indexing      IndexingScheme
+	overflow      uint32
+	kickTimeout   time.Duration
+	kickStep      uint16
+	kickLimit     uint16
+	softCap       float64
+	readLimit     int64
+	maxKeySize    int
+	hashCounting  bool
+	deleteSafety  bool
+	failureWindow int
+	rnd           *rand.Rand
+	growth        float64
+}
+
+// defaultOptions returns the options of a StdFilter
+func defaultOptions() *options {
+	return &options{
+		capacity:   safeItems(defaultTotalBuckets*defaultBucketSize, defaultBucketSize),
+		bucketSize: defaultBucketSize,
+		maxKicks:   defaultMaxKicks,
+		order:      binary.BigEndian,
+		seed:       seed,
+		growth:     scalableGrowth,
+	}
+}
+
+// optionsOf returns the default options configured by opts
+func optionsOf(opts []Option) (*options, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// NewWithOptions returns the filter configured by opts. Without options it's
+// the same as StdFilter
+func NewWithOptions(opts ...Option) (*Filter, error) {
+	o, err := optionsOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.newHash != nil && o.indexing == AltSeedIndexing {
+		return nil, fmt.Errorf("AltSeedIndexing hashes fingerprints with murmur3, so it can't be used with WithHash")
+	}
+
+	tb, err := bucketsFor(o.capacity, o.bucketSize)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newFilter(tb, o.bucketSize, hasherPool(defaultHash))
+	f.maxKicks = o.maxKicks
+	f.victim = o.victim
+	f.kickStart = o.kickStart
+	f.deterministic = o.deterministic
+	f.evictHook = o.evictHook
+	f.transform = o.transform
+	switch {
+	case o.newHash != nil:
+		f.seed, f.hashers, f.customHash = o.seed, hasherPool(o.newHash), true
+		f.hashID = hashIDOf(f.hashers)
+	case o.seed != seed:
+		f.seed, f.hashers = o.seed, hasherPool(murmurHash(o.seed))
+		f.hashID = hashIDOf(f.hashers)
+	}
+	f.lengthPrefix = o.lengthPrefix
+	f.strictKeys = o.strictKeys
+	f.order = o.order
+	f.indexing = o.indexing
+	f.kickTimeout = o.kickTimeout
+	f.kickStep, f.kickLimit = o.kickStep, o.kickLimit
+	f.softCap = o.softCap
+	f.readLimit = o.readLimit
+	f.maxKeySize = o.maxKeySize
+	if o.hashCounting {
+		f.hashOps = new(atomic.Uint64)
+	}
+	f.rnd = o.rnd
+	if o.failureWindow > 0 {
+		f.stats.recent = newFailureWindow(o.failureWindow)
+	}
+	if o.deleteSafety {
+		f.refs = make(map[refKey]uint32)
+	}
+	if o.overflow > 0 {
+		f.overflow = newBloomFilter(o.overflow)
+	}
+
+	return f, nil
+}
+
+// Reseed returns a filter for count items hashed with seed s, holding items. It's
+// the remedy for items the current seed crowds into too few buckets, which
+// needs the items since a filter can't recover them. Returns ErrFilterFull if
+// the items don't fit and ErrInvalidInput for items the filter can't hold
+func Reseed(items [][]byte, count uint32, s uint32) (*Filter, error) {
+	f, err := NewWithOptions(WithCapacity(count), WithSeed(s))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, x := range items {
+		if err := f.UInsertWithError(x); err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, fitError(err))
+		}
+	}
+
+	return f, nil
+}
+
+// WithCapacity sizes the filter to hold count items within the estimated load
+// factor of its bucket size, in the fewest power of 2 buckets that do. A
+// count filling a power of 2 of slots past that load takes twice the slots.
+// Building fails with ErrCapacityTooTight if no filter holds count items
+func WithCapacity(count uint32) Option {
+	return func(o *options) error {
+		if count == 0 {
+			return fmt.Errorf("capacity must be greater than 0")
+		}
+
+		o.capacity = count
+		return nil
+	}
+}
+
+// WithBucketSize sets the slots per bucket, up to 16. Larger buckets fill to a
+// higher load factor at a higher false positive rate
+func WithBucketSize(bs uint8) Option {
+	return func(o *options) error {
+		if bs == 0 || bs > maxBucketSize {
+			return fmt.Errorf("doesn't support %d bucket size. Max bucket size is %d", bs, maxBucketSize)
+		}
+
+		o.bucketSize = bs
+		return nil
+	}
+}
+
+// WithMaxKicks sets how many fingerprints an insert kicks before failing
+func WithMaxKicks(n uint16) Option {
+	return func(o *options) error {
+		if n == 0 {
+			return fmt.Errorf("max kicks must be greater than 0")
+		}
+
+		o.maxKicks = n
+		return nil
+	}
+}
+
+// WithHash sets the hash items and fingerprints are hashed with in place of
+// murmur3. newHash is called for every hasher the filter pools, so concurrent
+// lookups never share one. The seed goes unused, and AltSeedIndexing, which
+// hashes with murmur3, can't be combined with it. Stored filters record an
+// id of the hash and are loaded WithLoadHash
+func WithHash(newHash func() hash.Hash32) Option {
+	return func(o *options) error {
+		if newHash == nil {
+			return fmt.Errorf("hash can't be nil")
+		}
+
+		o.newHash = newHash
+		return nil
+	}
+}
+
+// VictimStrategy picks the slot of a full bucket to kick out while inserting.
+// fps is a copy of the fingerprints of the bucket in slot order. The returned
+// slot is taken modulo len(fps)
+type VictimStrategy func(fps []Fingerprint) int
+
+// RandomVictim picks the victim slot at random. It's the default
+var RandomVictim VictimStrategy
+
+// RoundRobinVictim returns a strategy cycling through the slots on every kick.
+// It keeps its own position, so each filter needs its own strategy, see
+// WithVictimStrategyFunc
+func RoundRobinVictim() VictimStrategy {
+	var next int
+	return func(fps []Fingerprint) int {
+		k := next % len(fps)
+		next++
+		return k
+	}
+}
+
+// WithVictimStrategy sets how the victim slot is chosen when kicking
+func WithVictimStrategy(s VictimStrategy) Option {
+	return func(o *options) error {
+		o.victim = s
+		return nil
+	}
+}
+
+// WithVictimStrategyFunc sets the strategy returned by newStrategy for every
+// filter the option builds, so the shards of a ShardedFilter or the filters
+// of a Pool each get their own stateful strategy, like RoundRobinVictim
+func WithVictimStrategyFunc(newStrategy func() VictimStrategy) Option {
+	return func(o *options) error {
+		if newStrategy == nil {
+			return fmt.Errorf("victim strategy func can't be nil")
+		}
+
+		o.victim = newStrategy()
+		return nil
+	}
+}
+
+// KickStartMode is which of the two full candidate buckets of an item kicking
+// starts from
+type KickStartMode uint8
+
+const (
+	// RandomKickStart picks either bucket at random, the default
+	RandomKickStart KickStartMode = iota
+
+	// LessFullKickStart picks the bucket whose fingerprints have more free
+	// slots in their alternate buckets, where the first kick lands. Both
+	// candidates are full when kicking starts, so counting their own slots
+	// couldn't tell them apart. Ties are broken at random. It hashes every
+	// fingerprint of both buckets, so it trades some time on each kicking
+	// insert for shorter kick chains near high load
+	LessFullKickStart
+
+	// PrimaryKickStart always picks the first bucket of the item
+	PrimaryKickStart
+)
+
+// WithKickStart sets which candidate bucket kicking starts from
+func WithKickStart(mode KickStartMode) Option {
+	return func(o *options) error {
+		if mode > PrimaryKickStart {
+			return fmt.Errorf("unknown kick start mode %d", mode)
+		}
+
+		o.kickStart = mode
+		return nil
+	}
+}
+
+// WithDeterministicPlacement derives the choices kicking makes from the
+// fingerprint, bucket and kick number instead of drawing them at random, so
+// the same inserts in the same order always build the same table. A custom
+// victim strategy still picks its own slots. Unlike a seeded rand source it
+// needs no setup per filter and no lock
+func WithDeterministicPlacement() Option {
+	return func(o *options) error {
+		o.deterministic = true
+		return nil
+	}
+}
+
+// WithEvictionHook sets fn to be called with every fingerprint kicked out of
+// its bucket while inserting, including kicks a failed insert later undoes.
+// fn runs under the write lock in the middle of the kick loop, so it must be
+// cheap and must not call back into the filter
+func WithEvictionHook(fn func(bucket uint32, fp Fingerprint)) Option {
+	return func(o *options) error {
+		o.evictHook = fn
+		return nil
+	}
+}
+
+// WithKeyTransform sets fn to rewrite every item before it's inserted, looked up
+// or deleted, e.g. to lowercase them. fn must not modify the passed slice
+func WithKeyTransform(fn func([]byte) []byte) Option {
+	return func(o *options) error {
+		o.transform = fn
+		return nil
+	}
+}
+
+// WithLengthPrefix hashes every item with its length prefixed as a uvarint, so
+// items of different lengths never alias, like {x} and {0, x} do by default.
+// Filters with and without it store the same items differently
+func WithLengthPrefix() Option {
+	return func(o *options) error {
+		o.lengthPrefix = true
+		return nil
+	}
+}
+
+// WithSeed sets the seed of the hash, so filters over the same items with
+// different seeds make independent false positives. Filters with different
+// seeds store the same items differently
+func WithSeed(s uint32) Option {
+	return func(o *options) error {
+		o.seed = s
+		return nil
+	}
+}
+
+// WithStrictKeys hashes items exactly as passed, without padding single byte
+// items to two bytes, so {x} and {0, x} are different items. Empty items
+// become valid too. Filters with and without it store short items differently
+func WithStrictKeys() Option {
+	return func(o *options) error {
+		o.strictKeys = true
+		return nil
+	}
+}
+
+// WithByteOrder sets the order fingerprints are read from the item hashes and
+// written in before hashing them for the alternate bucket, to match filters
+// built by other implementations. Only binary.BigEndian, the default, and
+// binary.LittleEndian are supported
+func WithByteOrder(order binary.ByteOrder) Option {
+	return func(o *options) error {
+		if order != binary.BigEndian && order != binary.LittleEndian {
+			return fmt.Errorf("unsupported byte order %v", order)
+		}
+
+		o.order = order
+		return nil
+	}
+}
+
+// IndexingScheme is how the alternate bucket of a fingerprint is found from
+// its bucket. Both schemes are involutions, the alternate of the alternate
+// is the bucket itself, which kicking relies on
+type IndexingScheme uint8
+
+const (
+	// StandardIndexing takes i xor hash(fp), the default. It's an involution
+	// only for a power of 2 bucket count
+	StandardIndexing IndexingScheme = iota
+
+	// PartialKeyIndexing takes hash(fp) - i modulo the bucket count, an
+	// involution for any bucket count
+	PartialKeyIndexing
+
+	// AltSeedIndexing takes i xor hash(fp) like StandardIndexing, hashing fp
+	// with a seed other than the one items are hashed with. The alternate
+	// bucket still only depends on fp, so it's the same involution. The item
+	// hash and the fingerprint hash have different inputs either way, and the
+	// false positive rate measures the same under both
+	AltSeedIndexing
+)
+
+// altSeedMask derives the seed AltSeedIndexing hashes fingerprints with from
+// the seed of the filter
+const altSeedMask = 0x9e3779b9
+
+// WithIndexing sets the indexing scheme, to match a reference implementation.
+// Filters with different schemes place fingerprints in different buckets
+func WithIndexing(scheme IndexingScheme) Option {
+	return func(o *options) error {
+		if scheme > AltSeedIndexing {
+			return fmt.Errorf("unknown indexing scheme %d", scheme)
+		}
+
+		o.indexing = scheme
+		return nil
+	}
+}
+
+// WithOverflowBloom adds a bloom filter sized for capacity items that takes the
+// items the filter can't fit. Lookup then matches items in either, at the
+// bloom's higher false positive rate. Delete can't remove items from the bloom
+// filter, so deleting a spilled item keeps it a member
+func WithOverflowBloom(capacity uint32) Option {
+	return func(o *options) error {
+		if capacity == 0 {
+			return fmt.Errorf("overflow capacity must be greater than 0")
+		}
+
+		o.overflow = capacity
+		return nil
+	}
+}
+
+// WithKickTimeout bounds how long an insert kicks fingerprints around before
+// giving up with ErrTimeout. The kicks are undone, leaving the filter as it was.
+// Zero means inserts are bounded by the max kicks alone
+func WithKickTimeout(d time.Duration) Option {
+	return func(o *options) error {
+		if d < 0 {
+			return fmt.Errorf("kick timeout %v can't be negative", d)
+		}
+
+		o.kickTimeout = d
+		return nil
+	}
+}
+
+// WithEscalatingKicks retries an insert that ran out of kicks with step more
+// kicks at a time, up to limit kicks, before failing it. The kicks of every
+// failed attempt are undone, so each retry starts from the same table. It
+// lets inserts near capacity take longer instead of failing. Inserts that
+// time out aren't retried
+func WithEscalatingKicks(step, limit uint16) Option {
+	return func(o *options) error {
+		if step == 0 || limit == 0 {
+			return fmt.Errorf("kick step and limit must be greater than 0")
+		}
+
+		o.kickStep, o.kickLimit = step, limit
+		return nil
+	}
+}
+
+// WithSoftCap rejects inserts with ErrSoftCapReached once the load factor
+// reaches loadFactor, to keep the false positive rate below what a fuller
+// filter would have. It must be in (0, 1]
+func WithSoftCap(loadFactor float64) Option {
+	return func(o *options) error {
+		if !(loadFactor > 0 && loadFactor <= 1) {
+			return fmt.Errorf("soft cap %v must be in (0, 1]", loadFactor)
+		}
+
+		o.softCap = loadFactor
+		return nil
+	}
+}
+
+// WithMaxReaderSize bounds how many bytes InsertReader and LookupReader read
+// for an item, failing longer ones with ErrKeyTooLarge. Defaults to 1MiB
+func WithMaxReaderSize(n int64) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max reader size must be greater than 0")
+		}
+
+		o.readLimit = n
+		return nil
+	}
+}
+
+// WithMaxKeySize rejects items longer than n bytes before hashing them, so
+// huge items can't stall the filter. Inserts fail with ErrKeyTooLarge, and
+// lookups and deletes of them return false. Items are unlimited by default
+func WithMaxKeySize(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("max key size must be greater than 0")
+		}
+
+		o.maxKeySize = n
+		return nil
+	}
+}
+
+// WithHashCounting counts the hashes the filter computes for HashOps. Every
+// located item takes two, its own and its fingerprint's, and finding the other
+// bucket of a stored fingerprint, like on every kick, takes one. The overflow
+// bloom filter's hashes aren't counted
+func WithHashCounting() Option {
+	return func(o *options) error {
+		o.hashCounting = true
+		return nil
+	}
+}
+
+// WithDeleteSafety counts the inserts of a fingerprint already stored in one
+// of its buckets as references to that copy instead of storing it again, and
+// Delete drops a reference before it frees the slot. Items sharing a
+// fingerprint and buckets then share a slot, so neither uses the room or runs
+// into ErrMaxMultiplicity. Count and the load factor count stored
+// fingerprints, not inserts. The references are kept beside the buckets, so
+// encodings, merges and resizes keep one copy of each shared fingerprint.
+// Deleting an item that was never inserted but shares a fingerprint and
+// buckets with one that was still drops that item's reference or slot
+func WithDeleteSafety() Option {
+	return func(o *options) error {
+		o.deleteSafety = true
+		return nil
+	}
+}
+
+// WithFailureWindow keeps the outcomes of the last n inserts for
+// RecentFailureRate
+func WithFailureWindow(n int) Option {
+	return func(o *options) error {
+		if n <= 0 {
+			return fmt.Errorf("failure window must be greater than 0")
+		}
+
+		o.failureWindow = n
+		return nil
+	}
+}
+
+// WithRandSource sets the source of the random choices made while kicking and
+// sampling, so the same inserts into filters with equally seeded sources lay
+// out the same buckets. The source is locked, as SampleFingerprints draws
+// from it under the read lock. Without it the filter uses the top level
+// math/rand functions, which take no lock and differ from run to run
+func WithRandSource(src rand.Source) Option {
+	// locked once here, so every filter built from the option shares the lock
+	// along with the source
+	var rnd *rand.Rand
+	if src != nil {
+		rnd = rand.New(&lockedSource{src: src})
+	}
+
+	return func(o *options) error {
+		if rnd == nil {
+			return fmt.Errorf("rand source can't be nil")
+		}
+
+		o.rnd = rnd
+		return nil
+	}
+}
+
+// WithGrowthFactor sets how many times the capacity of the last segment a new
+// segment of a ScalableFilter has. It must be greater than 1, and defaults to
+// 2. Filters built on their own ignore it
+func WithGrowthFactor(factor float64) Option {
+	return func(o *options) error {
+		if !(factor > 1) {
+			return fmt.Errorf("growth factor %v must be greater than 1", factor)
+		}
+
+		o.growth = factor
+		return nil
+	}
+}
@@ -0,0 +1,1056 @@
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spaolacci/murmur3"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1 << 10))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if g := NewFilter(1 << 10); f.totalBuckets != g.totalBuckets || f.bucketSize != g.bucketSize || f.UConfig() != g.UConfig() {
+		t.Fatalf("expected NewFilter geometry but got %d buckets of %d", f.totalBuckets, f.bucketSize)
+	}
+
+	f4, _ := NewWithOptions(WithCapacity(1<<10), WithBucketSize(4))
+	if g, err := NewFilterWithBucketSize(1<<10, 4); err != nil || g.UConfig() != f4.UConfig() {
+		t.Fatalf("expected NewFilterWithBucketSize to build like the options but got %v", err)
+	}
+
+	if _, err := NewWithOptions(WithCapacity(0)); err == nil {
+		t.Fatalf("expected error for 0 capacity")
+	}
+}
+
+func TestWithBucketSize(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(900), WithBucketSize(4), WithMaxKicks(20))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f.totalBuckets != 1<<10/4 || f.bucketSize != 4 || f.maxKicks != 20 {
+		t.Fatalf("expected %d buckets of 4 with 20 kicks but got %d of %d with %d",
+			1<<10/4, f.totalBuckets, f.bucketSize, f.maxKicks)
+	}
+
+	for _, opt := range []Option{WithBucketSize(0), WithBucketSize(17), WithMaxKicks(0)} {
+		if _, err := NewWithOptions(opt); err == nil {
+			t.Fatalf("expected error for an invalid option")
+		}
+	}
+}
+
+func TestWithHash(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithHash(fnv.New32a))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	x := []byte("gopher")
+	h := f.hashers.Get().(*hasher)
+	got := keyHash(f, x, h)
+	f.hashers.Put(h)
+	if got != hashOf(x, fnv.New32a()) {
+		t.Fatalf("expected the key to be hashed with fnv")
+	}
+
+	if _, err := NewWithOptions(WithHash(nil)); err == nil {
+		t.Fatalf("expected error for a nil hash")
+	}
+
+	if _, err := NewWithOptions(WithHash(fnv.New32a), WithIndexing(AltSeedIndexing)); err == nil {
+		t.Fatalf("expected error for AltSeedIndexing with a custom hash")
+	}
+
+	if f.CompatibleWith(NewFilter(1 << 10)) {
+		t.Fatalf("expected filters of different hashes not to be compatible")
+	}
+}
+
+func TestWithHash_hashes(t *testing.T) {
+	// wrong are hashes loading fails with, nil loading without WithLoadHash
+	tests := []struct {
+		name    string
+		newHash func() hash.Hash32
+		wrong   []func() hash.Hash32
+	}{
+		{"murmur3", nil, []func() hash.Hash32{fnv.New32a}},
+		{"fnv", fnv.New32a, []func() hash.Hash32{nil, fnv.New32, crc32.NewIEEE}},
+		{"crc32", crc32.NewIEEE, []func() hash.Hash32{nil, fnv.New32a}},
+	}
+
+	for _, c := range tests {
+		opts := []Option{WithCapacity(1 << 12)}
+		var load []LoadOption
+		if c.newHash != nil {
+			opts = append(opts, WithHash(c.newHash))
+			load = append(load, WithLoadHash(c.newHash))
+		}
+
+		f, err := NewWithOptions(opts...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		var items [][]byte
+		for i := 0; i < 2000; i++ {
+			x := []byte(fmt.Sprintf("item-%d", i))
+			if !f.Insert(x) {
+				t.Fatalf("%s: insert failed: %s", c.name, x)
+			}
+
+			items = append(items, x)
+		}
+
+		for _, x := range items[:1000] {
+			if !f.Delete(x) {
+				t.Fatalf("%s: delete failed: %s", c.name, x)
+			}
+		}
+
+		if f.Count() != 1000 {
+			t.Fatalf("%s: expected 1000 count but got %d", c.name, f.Count())
+		}
+
+		b, err := f.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		var buf bytes.Buffer
+		if err := f.Encode(&buf); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		rf, err := ReadFromParallel(bytes.NewReader(b), 2, load...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		df, err := Decode(&buf, load...)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		uf, _ := NewWithOptions(opts...)
+		if err := uf.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		for _, lf := range []*Filter{f, rf, df, uf} {
+			if !lf.CompatibleWith(f) {
+				t.Fatalf("%s: expected the loaded filter to hash like the stored one", c.name)
+			}
+
+			for _, x := range items[1000:] {
+				if !lf.Lookup(x) {
+					t.Fatalf("%s: lookup failed: %s", c.name, x)
+				}
+			}
+		}
+
+		for _, newHash := range c.wrong {
+			var wrong []LoadOption
+			if newHash != nil {
+				wrong = append(wrong, WithLoadHash(newHash))
+			}
+
+			if _, err := ReadFromParallel(bytes.NewReader(b), 1, wrong...); !errors.Is(err, ErrHashMismatch) {
+				t.Fatalf("%s: expected %v but got %v", c.name, ErrHashMismatch, err)
+			}
+
+			if _, err := ReadFrom(bytes.NewReader(b), wrong...); !errors.Is(err, ErrHashMismatch) {
+				t.Fatalf("%s: expected %v but got %v", c.name, ErrHashMismatch, err)
+			}
+
+			var buf bytes.Buffer
+			f.Encode(&buf)
+			if _, err := Decode(&buf, wrong...); !errors.Is(err, ErrHashMismatch) {
+				t.Fatalf("%s: expected %v but got %v", c.name, ErrHashMismatch, err)
+			}
+		}
+	}
+}
+
+func TestWithVictimStrategy(t *testing.T) {
+	var calls int
+	// negative and out of range slots wrap around the bucket
+	custom := func(fps []Fingerprint) int {
+		calls++
+		return -calls
+	}
+
+	tests := []struct {
+		name string
+		s    VictimStrategy
+	}{
+		{
+			name: "random",
+			s:    RandomVictim,
+		},
+
+		{
+			name: "round robin",
+			s:    RoundRobinVictim(),
+		},
+
+		{
+			name: "custom",
+			s:    custom,
+		},
+	}
+
+	for _, c := range tests {
+		f, err := NewWithOptions(WithCapacity(1<<10), WithVictimStrategy(c.s))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// stay clear of a failed insert so every item must be found
+		var items [][]byte
+		for i := 0; f.LoadFactor() < 0.9; i++ {
+			x := []byte(fmt.Sprintf("item-%d", i))
+			if !f.Insert(x) {
+				t.Fatalf("%s: unexpected insert failure at load %0.4f", c.name, f.LoadFactor())
+			}
+
+			items = append(items, x)
+		}
+
+		for _, x := range items {
+			if !f.Lookup(x) {
+				t.Fatalf("%s: lookup failed: %s", c.name, x)
+			}
+		}
+	}
+
+	if calls == 0 {
+		t.Fatalf("expected custom strategy to be used")
+	}
+}
+
+func TestWithKickStart(t *testing.T) {
+	tests := []struct {
+		name string
+		mode KickStartMode
+	}{
+		{"random", RandomKickStart},
+		{"less full", LessFullKickStart},
+		{"primary", PrimaryKickStart},
+	}
+
+	for _, c := range tests {
+		f, err := NewWithOptions(WithCapacity(1<<10), WithKickStart(c.mode), WithRandSource(rand.NewSource(1)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var items [][]byte
+		for i := 0; f.LoadFactor() < 0.9; i++ {
+			x := []byte(fmt.Sprintf("item-%d", i))
+			if !f.Insert(x) {
+				t.Fatalf("%s: unexpected insert failure at load %0.4f", c.name, f.LoadFactor())
+			}
+
+			items = append(items, x)
+		}
+
+		for _, x := range items {
+			if !f.Lookup(x) {
+				t.Fatalf("%s: lookup failed: %s", c.name, x)
+			}
+		}
+
+		for i := uint32(1); i < f.totalBuckets; i++ {
+			start := kickStartOf(f, 0, i-1, i)
+			switch r1, r2 := roomAround(f, i-1), roomAround(f, i); {
+			case c.mode == PrimaryKickStart && start != i-1:
+				t.Fatalf("%s: expected to start from %d but got %d", c.name, i-1, start)
+			case c.mode == LessFullKickStart && r1 > r2 && start != i-1,
+				c.mode == LessFullKickStart && r1 < r2 && start != i:
+				t.Fatalf("%s: expected to start from the bucket with more room, got %d with %d and %d", c.name, start, r1, r2)
+			}
+		}
+	}
+
+	if _, err := NewWithOptions(WithKickStart(PrimaryKickStart + 1)); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
+
+func TestWithDeterministicPlacement(t *testing.T) {
+	var encoded [][]byte
+	for n := 0; n < 2; n++ {
+		f, err := NewWithOptions(WithCapacity(1<<10), WithDeterministicPlacement())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var items [][]byte
+		for i := 0; f.LoadFactor() < 0.95; i++ {
+			x := []byte(fmt.Sprintf("item-%d", i))
+			if !f.Insert(x) {
+				t.Fatalf("unexpected insert failure at load %0.4f", f.LoadFactor())
+			}
+
+			items = append(items, x)
+		}
+
+		for _, x := range items {
+			if !f.Lookup(x) {
+				t.Fatalf("lookup failed: %s", x)
+			}
+		}
+
+		b, err := appendBinary(f, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		encoded = append(encoded, b)
+	}
+
+	if !bytes.Equal(encoded[0], encoded[1]) {
+		t.Fatalf("expected the same inserts to build the same table")
+	}
+}
+
+func TestWithMaxKeySize(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithMaxKeySize(8))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	long := []byte("longer than 8")
+	if err := f.InsertWithError(long); !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("expected %v but got %v", ErrKeyTooLarge, err)
+	}
+
+	if !f.Insert([]byte("12345678")) || !f.Lookup([]byte("12345678")) || f.Lookup(long) || f.Delete(long) {
+		t.Fatalf("expected only items up to 8 bytes to be held")
+	}
+
+	if _, err := NewWithOptions(WithMaxKeySize(0)); err == nil {
+		t.Fatalf("expected error for max key size 0")
+	}
+}
+
+func TestWithHashCounting(t *testing.T) {
+	if f := NewFilter(1 << 10); f.Lookup([]byte("hello")) || f.HashOps() != 0 {
+		t.Fatalf("expected no count without the option")
+	}
+
+	f, err := NewWithOptions(WithCapacity(1<<10), WithHashCounting())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var attempts uint64
+	for i := 0; f.LoadFactor() < 0.9; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+		attempts++
+	}
+
+	f.Lookup([]byte("hello"))
+	if st := f.Stats(); f.HashOps() != 2*(attempts+1)+st.Kicks {
+		t.Fatalf("expected %d hashes but got %d", 2*(attempts+1)+st.Kicks, f.HashOps())
+	}
+}
+
+func TestWithDeleteSafety(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithDeleteSafety())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// more copies than its buckets have slots
+	x := []byte("gopher")
+	for i := 0; i < 20; i++ {
+		if err := f.InsertWithError(x); err != nil {
+			t.Fatalf("unexpected error on copy %d: %v", i, err)
+		}
+	}
+
+	if f.Count() != 1 || f.CountOf(x) != 20 {
+		t.Fatalf("expected 20 references to 1 fingerprint but got %d of %d", f.CountOf(x), f.Count())
+	}
+
+	for i := 0; i < 19; i++ {
+		if !f.Delete(x) || !f.Lookup(x) {
+			t.Fatalf("expected delete %d to keep the item", i)
+		}
+	}
+
+	if !f.Delete(x) || f.Lookup(x) || f.Count() != 0 || f.Delete(x) {
+		t.Fatalf("expected the last delete to free the slot")
+	}
+
+	f.InsertN(x, 3)
+	if n := f.DeleteAll(x); n != 3 || f.CountOf(x) != 0 {
+		t.Fatalf("expected to delete 3 copies but deleted %d", n)
+	}
+
+	// freeing the slot directly drops its references
+	f.InsertN(x, 3)
+	fp, i1, i2 := locate(f, x)
+	for _, i := range []uint32{i1, i2} {
+		for j, v := range f.buckets[i].FPs {
+			if isSet(f.buckets[i].Track, uint8(j)) && v == fp {
+				f.DeleteAt(i, j)
+			}
+		}
+	}
+
+	if len(f.refs) != 0 || f.Lookup(x) {
+		t.Fatalf("expected no references left but got %v", f.refs)
+	}
+
+	// the references move with the fingerprints on a swap
+	f.InsertN(x, 2)
+	if err := f.Swap(NewFilter(1 << 10)); err == nil || f.CountOf(x) != 2 {
+		t.Fatalf("expected a swap with a filter without delete safety to fail")
+	}
+
+	other, _ := NewWithOptions(WithCapacity(1<<10), WithDeleteSafety())
+	if err := f.Swap(other); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !other.Delete(x) || !other.Lookup(x) || f.Lookup(x) {
+		t.Fatalf("expected the swapped filter to keep the item after a delete")
+	}
+}
+
+func TestFilter_DeleteCollision(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithDeleteSafety()}} {
+		f, _ := NewWithOptions(append(opts, WithCapacity(1<<6))...)
+		a := []byte("item-0")
+		var b []byte
+		for i := 1; b == nil; i++ {
+			if x := []byte(fmt.Sprintf("item-%d", i)); f.WouldCollide(a, x) {
+				b = x
+			}
+		}
+
+		fa, a1, a2 := locate(f, a)
+		fb, b1, b2 := locate(f, b)
+		if fa != fb || min(a1, a2) != min(b1, b2) || max(a1, a2) != max(b1, b2) {
+			t.Fatalf("expected %s and %s to share a fingerprint and buckets", a, b)
+		}
+
+		// either copy of the shared fingerprint stands for either item
+		f.Insert(a)
+		f.Insert(b)
+		if !f.Delete(a) || !f.Lookup(b) || !f.Delete(b) || f.Lookup(b) {
+			t.Fatalf("expected deleting %s to keep %s", a, b)
+		}
+	}
+}
+
+func TestWithKeyTransform(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithKeyTransform(bytes.ToLower))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.Insert([]byte("Gopher"))
+	if !f.Lookup([]byte("GOPHER")) || !f.Lookup([]byte("gopher")) {
+		t.Fatalf("expected lookup to be case insensitive")
+	}
+
+	if !f.InsertUnique([]byte("GoPhEr")) || f.Count() != 1 {
+		t.Fatalf("expected unique insert to find the transformed item")
+	}
+
+	if !f.Delete([]byte("GOPHER")) || f.Lookup([]byte("gopher")) {
+		t.Fatalf("expected delete to use the transformed item")
+	}
+}
+
+func TestWithLengthPrefix(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithLengthPrefix())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.Insert([]byte{5})
+	if !f.Lookup([]byte{5}) || f.Lookup([]byte{0, 5}) {
+		t.Fatalf("expected {5} and {0, 5} to be different items")
+	}
+
+	if err := f.InsertWithError(nil); err != ErrInvalidInput {
+		t.Fatalf("expected %v but got %v", ErrInvalidInput, err)
+	}
+
+	var b bytes.Buffer
+	if err := f.Encode(&b); err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "filter"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fd.Close()
+
+	if err := f.WriteToParallel(fd, 2); err != nil {
+		t.Fatalf("unexpected error while writing: %v", err)
+	}
+
+	rf, err := ReadFromParallel(fd, 2)
+	if err != nil {
+		t.Fatalf("unexpected error while reading: %v", err)
+	}
+
+	for _, g := range []*Filter{df, rf} {
+		if !g.lengthPrefix || !g.Lookup([]byte{5}) || g.Lookup([]byte{0, 5}) {
+			t.Fatalf("expected the length prefix to be carried over")
+		}
+	}
+
+	if err := f.Swap(NewFilter(1 << 10)); err == nil {
+		t.Fatalf("expected error swapping with a filter hashing keys differently")
+	}
+}
+
+func TestWithStrictKeys(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithStrictKeys())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := f.InsertWithError(nil); err != nil {
+		t.Fatalf("expected empty items to be valid but got %v", err)
+	}
+
+	f.Insert([]byte{5})
+	if !f.Lookup([]byte{}) || !f.Lookup([]byte{5}) || f.Lookup([]byte{0, 5}) {
+		t.Fatalf("expected {5} and {0, 5} to be different items")
+	}
+
+	var b bytes.Buffer
+	if err := f.Encode(&b); err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	if !df.strictKeys || !df.Lookup([]byte{5}) || df.Lookup([]byte{0, 5}) {
+		t.Fatalf("expected strict keys to be carried over")
+	}
+}
+
+func TestWithByteOrder(t *testing.T) {
+	if _, err := NewWithOptions(WithByteOrder(nil)); err == nil {
+		t.Fatalf("expected error for unsupported byte order")
+	}
+
+	f, err := NewWithOptions(WithCapacity(1<<10), WithByteOrder(binary.LittleEndian))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	x := []byte("hello")
+	f.Insert(x)
+	h := murmur3.New32WithSeed(seed)
+	h.Write(x)
+	b1, b2 := f.BucketsFor(x)
+	if fp := binary.LittleEndian.Uint16(h.Sum(nil)); len(b1)+len(b2) != 1 || append(b1, b2...)[0] != Fingerprint(fp) {
+		t.Fatalf("expected little endian fingerprint %d but got %v %v", fp, b1, b2)
+	}
+
+	var b bytes.Buffer
+	if err := f.Encode(&b); err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "filter"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fd.Close()
+
+	if err := f.WriteToParallel(fd, 2); err != nil {
+		t.Fatalf("unexpected error while writing: %v", err)
+	}
+
+	rf, err := ReadFromParallel(fd, 2)
+	if err != nil {
+		t.Fatalf("unexpected error while reading: %v", err)
+	}
+
+	for _, g := range []*Filter{df, rf} {
+		if g.order != binary.LittleEndian || !g.Lookup(x) {
+			t.Fatalf("expected the byte order to be carried over")
+		}
+	}
+}
+
+func TestWithOverflowBloom(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(60), WithOverflowBloom(1000))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; i < 500; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		if !f.Insert(x) {
+			t.Fatalf("expected insert to spill into the bloom filter")
+		}
+
+		items = append(items, x)
+	}
+
+	if f.Count() > 64 {
+		t.Fatalf("expected only the filter inserts to be counted but got %d", f.Count())
+	}
+
+	var b bytes.Buffer
+	if err := f.Encode(&b); err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) || !df.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+}
+
+func TestAltSeedIndexing(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		for fp := 0; fp < 1<<16; fp += 97 {
+			var b [2]byte
+			order.PutUint16(b[:], uint16(fp))
+			h := murmur3.New32WithSeed(seed ^ altSeedMask)
+			h.Write(b[:])
+			if murmur3Of2(b, seed^altSeedMask) != h.Sum32() {
+				t.Fatalf("murmur3 mismatch for %x", b)
+			}
+		}
+	}
+
+	// the same items and kicks land alternate buckets apart from StandardIndexing
+	var fprs [2]float64
+	for n, scheme := range []IndexingScheme{StandardIndexing, AltSeedIndexing} {
+		f, err := NewWithOptions(WithCapacity(1<<14), WithIndexing(scheme), WithRandSource(rand.NewSource(1)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var items [][]byte
+		for i := 0; f.LoadFactor() < 0.9; i++ {
+			x := []byte(fmt.Sprintf("item-%d", i))
+			if !f.Insert(x) {
+				t.Fatalf("unexpected insert failure at load %0.4f", f.LoadFactor())
+			}
+
+			items = append(items, x)
+		}
+
+		for _, x := range items {
+			fp, i1, i2 := locate(f, x)
+			if alternateIndex(scheme, f.totalBuckets, f.mask, i2, altHash(f, fp)) != i1 || !f.Lookup(x) {
+				t.Fatalf("scheme %d: alternate bucket of %s doesn't map back", scheme, x)
+			}
+		}
+
+		b, err := appendBinary(f, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var gb bytes.Buffer
+		if err := f.Encode(&gb); err != nil {
+			t.Fatalf("unexpected error while encoding: %v", err)
+		}
+
+		rf, err := ReadFromParallel(bytes.NewReader(b), 2)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		df, err := Decode(&gb)
+		if err != nil {
+			t.Fatalf("unexpected error while decoding: %v", err)
+		}
+
+		if rf.indexing != scheme || df.indexing != scheme || !rf.Lookup(items[0]) || !df.Lookup(items[0]) {
+			t.Fatalf("scheme %d: expected the indexing scheme to be carried over", scheme)
+		}
+
+		var hits int
+		for i := 0; i < 1<<18; i++ {
+			if f.Lookup([]byte(fmt.Sprintf("other-%d", i))) {
+				hits++
+			}
+		}
+
+		fprs[n] = float64(hits) / (1 << 18)
+	}
+
+	// both are within noise of 2b/2^16
+	bound := 1.25 * expectedFPR(defaultBucketSize, fingerprintBits)
+	for n, fpr := range fprs {
+		if fpr > bound {
+			t.Fatalf("scheme %d: false positive rate %v over %v", n, fpr, bound)
+		}
+	}
+
+	t.Logf("false positive rate %v standard, %v alt seed", fprs[0], fprs[1])
+}
+
+func TestWithKickTimeout(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<14), WithKickTimeout(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; ; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		err := f.InsertWithError(x)
+		if err == nil {
+			items = append(items, x)
+			continue
+		}
+
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("expected %v but got %v", ErrTimeout, err)
+		}
+
+		break
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed after timed out insert: %s", x)
+		}
+	}
+
+	if _, err := NewWithOptions(WithKickTimeout(-time.Second)); err == nil {
+		t.Fatalf("expected error for negative timeout")
+	}
+}
+
+func TestWithEscalatingKicks(t *testing.T) {
+	fill := func(opts ...Option) (int, int) {
+		f, err := NewWithOptions(append(opts, WithCapacity(1<<12), WithRandSource(rand.NewSource(1)))...)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		f.maxKicks = 10
+		for i := 0; ; i++ {
+			if ok, kicks := f.InsertTraced([]byte(fmt.Sprintf("item-%d", i))); !ok {
+				return i, kicks
+			}
+		}
+	}
+
+	n, kicks := fill()
+	if kicks != 10 {
+		t.Fatalf("expected the failed insert to kick 10 times but got %d", kicks)
+	}
+
+	// retries with up to 200 kicks fill the filter past where 10 kicks fail
+	if en, _ := fill(WithEscalatingKicks(10, 200)); en <= n {
+		t.Fatalf("expected more than %d items before failing but got %d", n, en)
+	}
+
+	if _, err := NewWithOptions(WithEscalatingKicks(0, 10)); err == nil {
+		t.Fatalf("expected error for zero step")
+	}
+}
+
+func TestWithSoftCap(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithSoftCap(0.8), WithOverflowBloom(1<<10))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var i int
+	for ; ; i++ {
+		err := f.InsertWithError([]byte(fmt.Sprintf("item-%d", i)))
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, ErrSoftCapReached) {
+			t.Fatalf("expected %v but got %v", ErrSoftCapReached, err)
+		}
+
+		break
+	}
+
+	// the cap isn't worked around by spilling to the bloom filter
+	if lf := f.LoadFactor(); lf < 0.8 || lf > 0.81 || f.overflow.contains([]byte(fmt.Sprintf("item-%d", i))) {
+		t.Fatalf("expected to stop at the soft cap without spilling but got a load of %0.4f", lf)
+	}
+
+	if x := []byte("unique"); f.InsertUnique(x) || f.overflow.contains(x) {
+		t.Fatalf("expected a unique insert to stop at the soft cap without spilling")
+	}
+
+	f.Delete([]byte("item-0"))
+	if !f.Insert([]byte("item-0")) {
+		t.Fatalf("expected room below the soft cap")
+	}
+
+	for _, c := range []float64{0, -0.5, 1.5} {
+		if _, err := NewWithOptions(WithSoftCap(c)); err == nil {
+			t.Fatalf("expected error for soft cap %v", c)
+		}
+	}
+}
+
+func TestWithRandSource(t *testing.T) {
+	var filters []*Filter
+	for i := 0; i < 2; i++ {
+		f, err := NewWithOptions(WithCapacity(1<<10), WithRandSource(rand.NewSource(42)))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// fill far enough to kick and fail
+		for j := 0; j < 1100; j++ {
+			f.Insert([]byte(fmt.Sprintf("item-%d", j)))
+		}
+
+		filters = append(filters, f)
+	}
+
+	if !reflect.DeepEqual(filters[0].buckets, filters[1].buckets) || filters[0].Count() != filters[1].Count() {
+		t.Fatalf("expected the same layout from the same seed")
+	}
+
+	// filters built from one option share the source and its lock, so
+	// kicking in both at once doesn't race
+	opt := WithRandSource(rand.NewSource(1))
+	a, _ := NewWithOptions(WithCapacity(1<<10), WithBucketSize(2), opt)
+	b, _ := NewWithOptions(WithCapacity(1<<10), WithBucketSize(2), opt)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		f := []*Filter{a, b}[w%2]
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				f.Insert([]byte(fmt.Sprintf("item-%d-%d", w, i)))
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	if a.rnd != b.rnd || a.Stats().Kicks == 0 || b.Stats().Kicks == 0 {
+		t.Fatalf("expected both filters to kick with the shared source")
+	}
+}
+
+func TestWithIndexing(t *testing.T) {
+	tests := []struct {
+		scheme IndexingScheme
+		tbs    []uint32
+	}{
+		{scheme: StandardIndexing, tbs: []uint32{1, 2, 64, 1 << 20}},
+		{scheme: PartialKeyIndexing, tbs: []uint32{1, 3, 64, 1000, 1<<31 + 7}},
+		{scheme: AltSeedIndexing, tbs: []uint32{1, 2, 64, 1 << 20}},
+	}
+
+	r := rand.New(rand.NewSource(1))
+	for _, c := range tests {
+		for _, tb := range c.tbs {
+			for n := 0; n < 1000; n++ {
+				i, fph := r.Uint32()%tb, r.Uint32()
+				mask := bucketMask(tb)
+				j := alternateIndex(c.scheme, tb, mask, i, fph)
+				if j >= tb || alternateIndex(c.scheme, tb, mask, j, fph) != i {
+					t.Fatalf("scheme %d isn't an involution for %d buckets at %d", c.scheme, tb, i)
+				}
+			}
+		}
+	}
+
+	if _, err := NewWithOptions(WithIndexing(AltSeedIndexing + 1)); err == nil {
+		t.Fatalf("expected error for unknown indexing scheme")
+	}
+
+	f, err := NewWithOptions(WithCapacity(1<<10), WithIndexing(PartialKeyIndexing))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; i < 900; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		if !f.Insert(x) {
+			t.Fatalf("insert failed: %s", x)
+		}
+
+		items = append(items, x)
+	}
+
+	var b bytes.Buffer
+	if err := f.Encode(&b); err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	if df.indexing != PartialKeyIndexing {
+		t.Fatalf("expected the indexing scheme to be carried over")
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) || !df.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	for _, x := range items {
+		if !f.Delete(x) {
+			t.Fatalf("delete failed: %s", x)
+		}
+	}
+
+	if f.Count() != 0 {
+		t.Fatalf("expected empty filter but got %d", f.Count())
+	}
+}
+
+func TestWithEvictionHook(t *testing.T) {
+	var evicted int
+	f, err := NewWithOptions(WithCapacity(250), WithEvictionHook(func(bucket uint32, fp Fingerprint) {
+		if bucket >= 1<<8/defaultBucketSize {
+			t.Fatalf("evicted from bucket %d out of range", bucket)
+		}
+
+		evicted++
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 300; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	if st := f.Stats(); evicted == 0 || uint64(evicted) != st.Kicks {
+		t.Fatalf("expected a call for each of %d kicks but got %d", st.Kicks, evicted)
+	}
+}
+
+func TestReseed(t *testing.T) {
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	f, err := Reseed(items, 1<<11, 7)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f.seed != 7 || f.Count() != 1000 {
+		t.Fatalf("expected 1000 items with seed 7 but got %d with seed %d", f.Count(), f.seed)
+	}
+
+	for _, x := range items {
+		if !f.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	if _, err := Reseed(items, 1<<8, 7); !errors.Is(err, ErrFilterFull) {
+		t.Fatalf("expected %v but got %v", ErrFilterFull, err)
+	}
+
+	if _, err := Reseed([][]byte{nil}, 1<<8, 7); !errors.Is(err, ErrInvalidInput) {
+		t.Fatalf("expected %v but got %v", ErrInvalidInput, err)
+	}
+}
+
+func TestWithSeed(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithSeed(7))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	x := []byte("hello")
+	f.Insert(x)
+	sb1, sb2 := f.BucketsFor(x)
+	db1, db2 := NewFilter(1 << 10).BucketsFor(x)
+	if reflect.DeepEqual(sb1, db1) && reflect.DeepEqual(sb2, db2) {
+		t.Fatalf("expected the seed to change where items go")
+	}
+
+	var b bytes.Buffer
+	if err := f.Encode(&b); err != nil {
+		t.Fatalf("unexpected error while encoding: %v", err)
+	}
+
+	df, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("unexpected error while decoding: %v", err)
+	}
+
+	fd, err := os.Create(filepath.Join(t.TempDir(), "filter"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fd.Close()
+
+	if err := f.WriteToParallel(fd, 2); err != nil {
+		t.Fatalf("unexpected error while writing: %v", err)
+	}
+
+	rf, err := ReadFromParallel(fd, 2)
+	if err != nil {
+		t.Fatalf("unexpected error while reading: %v", err)
+	}
+
+	for _, g := range []*Filter{df, rf} {
+		if g.seed != 7 || !g.Lookup(x) {
+			t.Fatalf("expected the seed to be carried over")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package cuckoo
+
+import (
+	"fmt"
+	"math"
+)
+
+// fingerprintBits is the width of a stored fingerprint
+const fingerprintBits = 16
+
+// recommendedBucketSizes are the bucket sizes estimatedLoadFactor is tuned for
+var recommendedBucketSizes = []uint8{4, 8, 16}
+
+// expectedFPR returns the upper bound on false positive rate for a bucket size
+// with the given fingerprint width, 2b/2^f from the paper
+func expectedFPR(bucketSize, bits uint8) float64 {
+	return float64(2*uint32(bucketSize)) / math.Exp2(float64(bits))
+}
+
+// RecommendParams returns the geometry needed to hold maxItems while keeping
+// the false positive rate at or below targetFPR. Of the bucket sizes meeting the
+// rate, the one needing the fewest slots wins, ties going to the smaller bucket.
+// It allocates nothing, so it can be used to plan memory before constructing a filter
+func RecommendParams(maxItems uint32, targetFPR float64) (totalBuckets uint32, bucketSize uint8, fpBits uint8, err error) {
+	if maxItems == 0 {
+		return 0, 0, 0, fmt.Errorf("max items must be greater than 0")
+	}
+
+	if targetFPR <= 0 || targetFPR >= 1 {
+		return 0, 0, 0, fmt.Errorf("target false positive rate %v must be between 0 and 1", targetFPR)
+	}
+
+	var slots uint64
+	for _, bs := range recommendedBucketSizes {
+		if expectedFPR(bs, fingerprintBits) > targetFPR {
+			continue
+		}
+
+		need := math.Ceil(float64(maxItems) / (estimatedLoadFactor(bs) * float64(bs)))
+		if need > 1<<31 {
+			continue
+		}
+
+		tb := nextPowerOf2(uint32(need))
+		if s := uint64(tb) * uint64(bs); slots == 0 || s < slots {
+			slots, totalBuckets, bucketSize = s, tb, bs
+		}
+	}
+
+	if slots == 0 {
+		return 0, 0, 0, fmt.Errorf("can't hold %d items at %v false positive rate with %d-bit fingerprints",
+			maxItems, targetFPR, fingerprintBits)
+	}
+
+	return totalBuckets, bucketSize, fingerprintBits, nil
+}
+
+// loadThreshold returns the load past which inserts start failing with high
+// probability for the bucket size, from the measured curves of cuckoo hashing
+// with two buckets per item. Sizes between the measured ones get the threshold
+// of the next smaller size, which is the conservative choice
+func loadThreshold(bucketSize uint8) float64 {
+	switch {
+	case bucketSize < 2:
+		return 0.5
+	case bucketSize < 4:
+		return 0.84
+	case bucketSize < 8:
+		return 0.95
+	case bucketSize < 16:
+		return 0.98
+	default:
+		return 0.99
+	}
+}
+
+// MaxItemsForFailureProb returns how many items a filter of the geometry can
+// take while keeping the probability of an insert failing below p. The
+// threshold of the bucket size is sharp with a window shrinking as 1/sqrt(slots),
+// so the load is backed off from it by sqrt(2ln(1/p)/slots). A p of 0 or less
+// can't be guaranteed and returns 0
+func MaxItemsForFailureProb(totalBuckets uint32, bucketSize uint8, p float64) uint32 {
+	slots := float64(totalBuckets) * float64(bucketSize)
+	if slots == 0 || p <= 0 {
+		return 0
+	}
+
+	load := loadThreshold(bucketSize)
+	if p < 1 {
+		load -= math.Sqrt(2 * math.Log(1/p) / slots)
+	}
+
+	if load <= 0 {
+		return 0
+	}
+
+	return uint32(math.Min(math.Floor(load*slots), math.MaxUint32))
+}
+
+// BloomComparison returns the bits a filter recommended by RecommendParams
+// takes to hold maxItems at targetFPR, and the bits an optimally sized bloom
+// filter takes for the same. The filter's bits are its fingerprints and the
+// 16 bit occupancy bitmap of each bucket, the slices holding them aren't
+// counted. Both are 0 if RecommendParams has no geometry for the arguments
+func BloomComparison(maxItems uint32, targetFPR float64) (cuckooBits, bloomBits uint64) {
+	tb, bs, bits, err := RecommendParams(maxItems, targetFPR)
+	if err != nil {
+		return 0, 0
+	}
+
+	cuckooBits = uint64(tb) * (uint64(bs)*uint64(bits) + 16)
+	return cuckooBits, uint64(optimalBloomBits(float64(maxItems), targetFPR))
+}
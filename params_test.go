@@ -0,0 +1,131 @@
+package cuckoo
+
+import "testing"
+
+func TestRecommendParams(t *testing.T) {
+	tests := []struct {
+		items uint32
+		fpr   float64
+		tb    uint32
+		bs    uint8
+		err   bool
+	}{
+		{
+			items: 1 << 20,
+			fpr:   0.01,
+			tb:    1 << 19,
+			bs:    4,
+		},
+
+		{
+			items: 64880,
+			fpr:   0.01,
+			tb:    4096,
+			bs:    16,
+		},
+
+		{
+			items: 1000,
+			fpr:   0.0003,
+			tb:    128,
+			bs:    8,
+		},
+
+		{
+			items: 1000,
+			fpr:   0.00013,
+			tb:    512,
+			bs:    4,
+		},
+
+		{
+			items: 1000,
+			fpr:   0.00001,
+			err:   true,
+		},
+
+		{
+			items: 0,
+			fpr:   0.01,
+			err:   true,
+		},
+
+		{
+			items: 1000,
+			fpr:   1,
+			err:   true,
+		},
+	}
+
+	for _, c := range tests {
+		tb, bs, bits, err := RecommendParams(c.items, c.fpr)
+		if c.err {
+			if err == nil {
+				t.Fatalf("expected error for %d items at %v", c.items, c.fpr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if tb != c.tb || bs != c.bs || bits != fingerprintBits {
+			t.Fatalf("expected %d buckets of %d but got %d buckets of %d with %d bits", c.tb, c.bs, tb, bs, bits)
+		}
+
+		if float64(c.items) > estimatedLoadFactor(bs)*float64(uint32(bs)*tb) {
+			t.Fatalf("recommended geometry can't hold %d items", c.items)
+		}
+	}
+}
+
+func TestMaxItemsForFailureProb(t *testing.T) {
+	tests := []struct {
+		tb    uint32
+		bs    uint8
+		p     float64
+		items uint32
+	}{
+		{tb: 1 << 20, bs: 4, p: 0.01, items: 3978373},
+		{tb: 1 << 10, bs: 1, p: 0.5, items: 474},
+		{tb: 1 << 10, bs: 3, p: 0.01, items: 2412},
+		{tb: 1 << 16, bs: 8, p: 1e-6, items: 509996},
+		{tb: 1 << 20, bs: 16, p: 1, items: 16609443},
+
+		// too small to back off far enough
+		{tb: 4, bs: 2, p: 1e-9, items: 0},
+		{tb: 1 << 10, bs: 4, p: 0, items: 0},
+		{tb: 0, bs: 4, p: 0.01, items: 0},
+	}
+
+	for _, c := range tests {
+		items := MaxItemsForFailureProb(c.tb, c.bs, c.p)
+		if items != c.items {
+			t.Fatalf("expected %d items for %d buckets of %d at %v but got %d", c.items, c.tb, c.bs, c.p, items)
+		}
+	}
+}
+
+func TestBloomComparison(t *testing.T) {
+	tests := []struct {
+		items  uint32
+		fpr    float64
+		cuckoo uint64
+		bloom  uint64
+	}{
+		{items: 1 << 20, fpr: 0.001, cuckoo: 41943040, bloom: 15075994},
+		{items: 1000, fpr: 0.1, cuckoo: 18432, bloom: 4793},
+
+		// no geometry for these
+		{items: 0, fpr: 0.01, cuckoo: 0, bloom: 0},
+		{items: 1000, fpr: 1e-9, cuckoo: 0, bloom: 0},
+	}
+
+	for _, c := range tests {
+		cuckoo, bloom := BloomComparison(c.items, c.fpr)
+		if cuckoo != c.cuckoo || bloom != c.bloom {
+			t.Fatalf("%d items at %v: expected %d and %d bits but got %d and %d", c.items, c.fpr, c.cuckoo, c.bloom, cuckoo, bloom)
+		}
+	}
+}
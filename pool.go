@@ -0,0 +1,56 @@
+package cuckoo
+
+import "sync"
+
+// Pool hands out empty filters of one configuration, reusing the buckets of
+// filters put back instead of allocating new ones
+type Pool struct {
+	pool   sync.Pool
+	config Config
+}
+
+// NewPool returns a pool of filters configured by opts, as NewWithOptions
+// builds them. Every filter is built from opts, so whatever they hold is
+// shared by the filters: a WithRandSource source is drawn from by all of them
+// under one lock, and hooks and strategies must be safe for concurrent use.
+// Set stateful strategies like RoundRobinVictim WithVictimStrategyFunc, so
+// each filter gets its own
+func NewPool(opts ...Option) (*Pool, error) {
+	f, err := NewWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pool{config: f.UConfig()}
+	p.pool.New = func() any {
+		// the options were validated above
+		f, _ := NewWithOptions(opts...)
+		f.pool = p
+		return f
+	}
+
+	f.pool = p
+	p.pool.Put(f)
+	return p, nil
+}
+
+// Get returns an empty filter from the pool
+func (p *Pool) Get() *Filter {
+	return p.pool.Get().(*Filter)
+}
+
+// Put empties f and returns it to the pool. f must not be used after. Only
+// filters the pool built are taken back, and of those closed ones and ones
+// reconfigured since, like by UnmarshalBinary or GrowBuckets, are dropped
+func (p *Pool) Put(f *Filter) {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	if f.pool != p || f.closed || f.UConfig() != p.config {
+		return
+	}
+
+	reset(f)
+	f.stats.clear()
+	p.pool.Put(f)
+}
@@ -0,0 +1,46 @@
+package cuckoo
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p, err := NewPool(WithCapacity(1<<10), WithSeed(7))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for n := 0; n < 3; n++ {
+		f := p.Get()
+		if f.Count() != 0 || f.seed != 7 || f.Stats() != (Stats{}) {
+			t.Fatalf("expected an empty filter with seed 7 but got %d items with seed %d", f.Count(), f.seed)
+		}
+
+		for i := 0; i < 100; i++ {
+			f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+		}
+
+		p.Put(f)
+	}
+
+	// filters from elsewhere aren't pooled, even configured like the pool's
+	other, _ := NewPool(WithCapacity(1<<10), WithSeed(7))
+	p.Put(other.Get())
+	p.Put(NewFilter(1 << 12))
+	for _, opt := range []Option{WithDeleteSafety(), WithOverflowBloom(1 << 10), WithKeyTransform(bytes.ToLower)} {
+		f, _ := NewWithOptions(WithCapacity(1<<10), WithSeed(7), opt)
+		p.Put(f)
+	}
+
+	for i := 0; i < 8; i++ {
+		if f := p.Get(); f.pool != p || f.refs != nil || f.overflow != nil || f.transform != nil {
+			t.Fatalf("expected an empty filter of the pool")
+		}
+	}
+
+	if _, err := NewPool(WithCapacity(0)); err == nil {
+		t.Fatalf("expected error for invalid options")
+	}
+}
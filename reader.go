@@ -0,0 +1,69 @@
+package cuckoo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// defaultMaxReaderSize is the most InsertReader and LookupReader read by default
+const defaultMaxReaderSize = 1 << 20
+
+// ErrKeyTooLarge is returned when an item is longer than the filter allows
+var ErrKeyTooLarge = errors.New("item is too large")
+
+// readKey reads all of r as an item, failing with ErrKeyTooLarge past the
+// filter's read limit. It reads without the lock so slow readers don't block the filter
+func readKey(f *Filter, r io.Reader) ([]byte, error) {
+	limit := f.readLimit
+	if limit <= 0 {
+		limit = defaultMaxReaderSize
+	}
+
+	x, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read item: %w", err)
+	}
+
+	if int64(len(x)) > limit {
+		return nil, ErrKeyTooLarge
+	}
+
+	return x, nil
+}
+
+// InsertReader reads all of r and inserts it as an item, like file contents.
+// Items longer than the max reader size fail with ErrKeyTooLarge
+func (f *Filter) InsertReader(r io.Reader) (bool, error) {
+	x, err := readKey(f, r)
+	if err != nil {
+		return false, err
+	}
+
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	if f.closed {
+		return false, ErrClosed
+	}
+
+	return f.UInsert(x), nil
+}
+
+// LookupReader reads all of r and checks if it exists in the filter as an item.
+// Items longer than the max reader size fail with ErrKeyTooLarge
+func (f *Filter) LookupReader(r io.Reader) (bool, error) {
+	x, err := readKey(f, r)
+	if err != nil {
+		return false, err
+	}
+
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	if f.closed {
+		return false, ErrClosed
+	}
+
+	return f.ULookup(x), nil
+}
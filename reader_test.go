@@ -0,0 +1,41 @@
+package cuckoo
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFilter_InsertLookupReader(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithMaxReaderSize(8))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ok, err := f.InsertReader(strings.NewReader("contents")); !ok || err != nil {
+		t.Fatalf("expected insert to succeed but got %v", err)
+	}
+
+	if ok, err := f.LookupReader(bytes.NewReader([]byte("contents"))); !ok || err != nil {
+		t.Fatalf("expected lookup to succeed but got %v", err)
+	}
+
+	if !f.Lookup([]byte("contents")) {
+		t.Fatalf("expected the read item to be the inserted one")
+	}
+
+	if _, err := f.InsertReader(strings.NewReader("too long contents")); err != ErrKeyTooLarge {
+		t.Fatalf("expected %v but got %v", ErrKeyTooLarge, err)
+	}
+
+	rerr := errors.New("read failed")
+	if _, err := f.LookupReader(iotest.ErrReader(rerr)); !errors.Is(err, rerr) {
+		t.Fatalf("expected %v but got %v", rerr, err)
+	}
+
+	if _, err := NewWithOptions(WithMaxReaderSize(0)); err == nil {
+		t.Fatalf("expected error for 0 max reader size")
+	}
+}
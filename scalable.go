@@ -0,0 +1,143 @@
+package cuckoo
+
+import "sync"
+
+// scalableGrowth is how many times the capacity of the last segment a new
+// segment of a ScalableFilter has by default
+const scalableGrowth = 2
+
+// ScalableFilter is a filter that grows instead of filling up. Items go into
+// the newest of a chain of segments, and a segment is added with
+// the growth factor times the capacity of the last when it can't take an item.
+// Every segment adds its own false positives, so lookups have up to the sum
+// of the false positive rates of the segments
+type ScalableFilter struct {
+	segments    []*Filter
+	capacity    uint32
+	maxCapacity uint32
+	growth      float64
+	opts        []Option
+
+	// protects above fields
+	L sync.RWMutex
+}
+
+// NewScalableFilter returns a ScalableFilter whose first segment holds
+// capacity items, every segment configured by opts. WithGrowthFactor sets how
+// much larger each new segment is
+func NewScalableFilter(capacity uint32, opts ...Option) (*ScalableFilter, error) {
+	o, err := optionsOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ScalableFilter{growth: o.growth, maxCapacity: safeItems(maxSlots, o.bucketSize), opts: opts}
+	if err := s.grow(capacity); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// grow adds a segment for capacity items. Not thread safe
+func (s *ScalableFilter) grow(capacity uint32) error {
+	// capped so the append never writes into the caller's options
+	f, err := NewWithOptions(append(s.opts[:len(s.opts):len(s.opts)], WithCapacity(capacity))...)
+	if err != nil {
+		return err
+	}
+
+	s.segments = append(s.segments, f)
+	s.capacity = capacity
+	return nil
+}
+
+// nextCapacity returns the capacity of the segment after the last, at least
+// one item larger so small factors still grow, up to the most a segment holds.
+// Not thread safe
+func (s *ScalableFilter) nextCapacity() uint32 {
+	next := max(float64(s.capacity)*s.growth, float64(s.capacity)+1)
+	return uint32(min(next, float64(s.maxCapacity)))
+}
+
+// canGrow returns true if an item failing to insert with err fits a new
+// segment. An item at max multiplicity or out of kicking time fails for its
+// own buckets, not the room left, so growing for it would add a segment per
+// run of duplicates
+func canGrow(err error) bool {
+	return err == ErrFilterFull || err == ErrSoftCapReached
+}
+
+// Insert inserts the item into the newest segment, adding a segment if it
+// can't take it. Items no filter can hold, like empty ones, aren't inserted
+func (s *ScalableFilter) Insert(x []byte) bool {
+	return s.InsertWithError(x) == nil
+}
+
+// InsertWithError inserts the item like Insert, returning why it couldn't.
+// ErrMaxMultiplicity and ErrTimeout are returned without growing
+func (s *ScalableFilter) InsertWithError(x []byte) error {
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	err := s.segments[len(s.segments)-1].UInsertWithError(x)
+	if !canGrow(err) {
+		return err
+	}
+
+	if err := s.grow(s.nextCapacity()); err != nil {
+		return err
+	}
+
+	return s.segments[len(s.segments)-1].UInsertWithError(x)
+}
+
+// Lookup checks if the item exists in any segment, newest first, stopping at
+// the first that holds it
+func (s *ScalableFilter) Lookup(x []byte) bool {
+	s.L.RLock()
+	defer s.L.RUnlock()
+
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if s.segments[i].ULookup(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Delete deletes the item from the newest segment holding it
+func (s *ScalableFilter) Delete(x []byte) bool {
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if s.segments[i].UDelete(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Count returns the items held across every segment
+func (s *ScalableFilter) Count() uint32 {
+	s.L.RLock()
+	defer s.L.RUnlock()
+
+	var n uint32
+	for _, f := range s.segments {
+		n += f.UCount()
+	}
+
+	return n
+}
+
+// Segments returns the number of segments
+func (s *ScalableFilter) Segments() int {
+	s.L.RLock()
+	defer s.L.RUnlock()
+
+	return len(s.segments)
+}
@@ -0,0 +1,112 @@
+package cuckoo
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestScalableFilter(t *testing.T) {
+	s, err := NewScalableFilter(1<<10, WithBucketSize(4))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; i < 10000; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		if !s.Insert(x) {
+			t.Fatalf("expected the filter to grow for item %d", i)
+		}
+
+		items = append(items, x)
+	}
+
+	if s.Segments() < 3 || s.Count() != 10000 {
+		t.Fatalf("expected 10000 items over several segments but got %d over %d", s.Count(), s.Segments())
+	}
+
+	for i, f := range s.segments[1:] {
+		if f.bucketSize != 4 || f.totalBuckets <= s.segments[i].totalBuckets {
+			t.Fatalf("expected segment %d to be larger than the last", i+1)
+		}
+	}
+
+	for _, x := range items {
+		if !s.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	for _, x := range items {
+		if !s.Delete(x) {
+			t.Fatalf("delete failed: %s", x)
+		}
+	}
+
+	if s.Count() != 0 || s.Insert(nil) {
+		t.Fatalf("expected an empty filter rejecting empty items")
+	}
+
+	if _, err := NewScalableFilter(0); err == nil {
+		t.Fatalf("expected error for 0 capacity")
+	}
+}
+
+func TestScalableFilter_duplicates(t *testing.T) {
+	s, err := NewScalableFilter(1 << 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	x := []byte("gopher")
+	var inserted int
+	for i := 0; i < 200; i++ {
+		err := s.InsertWithError(x)
+		if err == nil {
+			inserted++
+			continue
+		}
+
+		if err != ErrMaxMultiplicity {
+			t.Fatalf("expected %v but got %v", ErrMaxMultiplicity, err)
+		}
+	}
+
+	copies := 2 * int(s.segments[0].bucketSize)
+	if s.Segments() != 1 || inserted != copies {
+		t.Fatalf("expected %d copies in 1 segment but got %d in %d", copies, inserted, s.Segments())
+	}
+}
+
+func TestScalableFilter_growthFactor(t *testing.T) {
+	s, err := NewScalableFilter(1000, WithGrowthFactor(4))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; s.Segments() < 3; i++ {
+		if !s.Insert([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("expected the filter to grow for item %d", i)
+		}
+	}
+
+	for i, f := range s.segments[1:] {
+		if f.totalBuckets != 4*s.segments[i].totalBuckets {
+			t.Fatalf("expected segment %d to be 4 times the last but got %d buckets after %d",
+				i+1, f.totalBuckets, s.segments[i].totalBuckets)
+		}
+	}
+
+	// a factor too small to add an item still grows
+	s, _ = NewScalableFilter(10, WithGrowthFactor(1.01))
+	if next := s.nextCapacity(); next != 11 {
+		t.Fatalf("expected the next segment to hold 11 items but got %d", next)
+	}
+
+	for _, factor := range []float64{1, 0.5, 0, -2, math.NaN()} {
+		if _, err := NewScalableFilter(1000, WithGrowthFactor(factor)); err == nil {
+			t.Fatalf("expected error for growth factor %v", factor)
+		}
+	}
+}
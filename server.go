@@ -0,0 +1,103 @@
+package cuckoo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Wire format of ServeFilter, all integers big endian:
+//
+//	request:  op uint8 | key length uint32 | key
+//	response: result uint8
+//
+// op is OpLookup or OpInsert. The result is 1 if the key was found or
+// inserted and 0 otherwise. Requests can be pipelined, their responses are
+// written in order. An unknown op or a key longer than MaxServeKeySize closes
+// the connection
+const (
+	OpLookup uint8 = 1
+	OpInsert uint8 = 2
+
+	// MaxServeKeySize is the longest key ServeFilter reads
+	MaxServeKeySize = 1 << 20
+)
+
+// ServeFilter accepts connections on ln and answers the lookups and inserts
+// sent over them on f. Each connection is served on its own goroutine. It
+// returns when ln fails to accept, like when it's closed, and always returns
+// a non nil error
+func ServeFilter(f *Filter, ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			_ = serveConn(f, conn)
+		}()
+	}
+}
+
+// serveConn answers requests from rw till it's closed or sends a bad request
+func serveConn(f *Filter, rw io.ReadWriter) error {
+	r := bufio.NewReader(rw)
+	w := bufio.NewWriter(rw)
+	var hdr [5]byte
+	var key []byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		n := binary.BigEndian.Uint32(hdr[1:])
+		if n > MaxServeKeySize {
+			return fmt.Errorf("key of %d bytes exceeds %d", n, MaxServeKeySize)
+		}
+
+		if cap(key) < int(n) {
+			key = make([]byte, n)
+		}
+
+		key = key[:n]
+		if _, err := io.ReadFull(r, key); err != nil {
+			return err
+		}
+
+		var ok bool
+		switch hdr[0] {
+		case OpLookup:
+			ok = f.Lookup(key)
+		case OpInsert:
+			ok = f.Insert(key)
+		default:
+			return fmt.Errorf("unknown op %d", hdr[0])
+		}
+
+		var res byte
+		if ok {
+			res = 1
+		}
+
+		if err := w.WriteByte(res); err != nil {
+			return err
+		}
+
+		// answer in batches of whatever was pipelined
+		if r.Buffered() > 0 {
+			continue
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestServeFilter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f := NewFilter(1 << 10)
+	f.Insert([]byte("hello"))
+	done := make(chan error, 1)
+	go func() { done <- ServeFilter(f, ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		op  uint8
+		key string
+		res byte
+	}{
+		{op: OpLookup, key: "hello", res: 1},
+		{op: OpLookup, key: "world", res: 0},
+		{op: OpInsert, key: "world", res: 1},
+		{op: OpLookup, key: "world", res: 1},
+		{op: OpInsert, key: "", res: 0},
+	}
+
+	// pipeline every request before reading the responses
+	var req []byte
+	for _, c := range tests {
+		req = append(req, c.op)
+		req = binary.BigEndian.AppendUint32(req, uint32(len(c.key)))
+		req = append(req, c.key...)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	res := make([]byte, len(tests))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, c := range tests {
+		if res[i] != c.res {
+			t.Fatalf("expected %d for op %d on %q but got %d", c.res, c.op, c.key, res[i])
+		}
+	}
+
+	// unknown ops close the connection
+	if _, err := conn.Write([]byte{9, 0, 0, 0, 0}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := conn.Read(res); err != io.EOF {
+		t.Fatalf("expected connection to be closed but got %v", err)
+	}
+
+	ln.Close()
+	if err := <-done; err == nil {
+		t.Fatalf("expected error once the listener is closed")
+	}
+}
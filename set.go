@@ -0,0 +1,33 @@
+package cuckoo
+
+// ApproxSet is a set that can report items it doesn't hold with the false
+// positive rate of its filter. Use it over a filter as ApproxSet{f}
+type ApproxSet struct {
+	*Filter
+}
+
+// Add adds the item, returning false if there's no room for it
+func (s ApproxSet) Add(x []byte) bool {
+	return s.Insert(x)
+}
+
+// Has returns true if the item was likely added
+func (s ApproxSet) Has(x []byte) bool {
+	return s.Lookup(x)
+}
+
+// Remove removes the item, returning false if it wasn't held. Only remove
+// items that were added, removing a false positive removes another item
+func (s ApproxSet) Remove(x []byte) bool {
+	return s.Delete(x)
+}
+
+// Len returns the number of items added, minus those removed
+func (s ApproxSet) Len() int {
+	return int(s.Count())
+}
+
+// Clear removes every item
+func (s ApproxSet) Clear() {
+	s.Reset()
+}
@@ -0,0 +1,34 @@
+package cuckoo
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApproxSet(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<10), WithOverflowBloom(1<<8))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s := ApproxSet{f}
+	for i := 0; i < 100; i++ {
+		if !s.Add([]byte(fmt.Sprintf("item-%d", i))) {
+			t.Fatalf("expected add to succeed")
+		}
+	}
+
+	if !s.Has([]byte("item-1")) || !s.Remove([]byte("item-1")) || s.Has([]byte("item-1")) || s.Len() != 99 {
+		t.Fatalf("expected item-1 to be removed leaving 99 items but got %d", s.Len())
+	}
+
+	f.overflow.add([]byte("spilled"))
+	s.Clear()
+	if s.Len() != 0 || s.Has([]byte("item-2")) || s.Has([]byte("spilled")) {
+		t.Fatalf("expected clear to empty the set and its overflow")
+	}
+
+	if !s.Add([]byte("item-2")) || !s.Has([]byte("item-2")) {
+		t.Fatalf("expected a cleared set to take items")
+	}
+}
@@ -0,0 +1,169 @@
+package cuckoo
+
+import (
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// maxShards is the most shards a ShardedFilter can have
+	maxShards = 1 << 16
+
+	// shardSeedMask derives the seed items are hashed to their shard with from
+	// the filter seed, so the shard is independent of the fingerprint and buckets
+	shardSeedMask = 0x85ebca6b
+)
+
+// ShardedFilter spreads items over shards, filters of their own with their own
+// locks, so operations on items of different shards don't contend. An item's
+// shard is chosen by a hash of its own, independent of its fingerprint and
+// buckets in the shard
+type ShardedFilter struct {
+	shards     []*Filter
+	mask       uint32
+	transform  func([]byte) []byte
+	maxKeySize int
+
+	// hashers hash items to their shard with murmur3 seeded apart from the shards
+	hashers *sync.Pool
+}
+
+// NewShardedFilter returns a ShardedFilter of shards shards, a power of 2, or
+// GOMAXPROCS rounded up to one if 0. opts configure every shard, with the
+// capacity split over them, and shards run concurrently, so whatever the
+// options hold is shared by every shard: a WithRandSource source is drawn
+// from by all of them under one lock, and hooks and strategies must be safe
+// for concurrent use. Set stateful strategies like RoundRobinVictim
+// WithVictimStrategyFunc, so each shard gets its own
+func NewShardedFilter(shards uint32, opts ...Option) (*ShardedFilter, error) {
+	if shards == 0 {
+		shards = defaultShards()
+	}
+
+	if !isPowerOf2(shards) || shards > maxShards {
+		return nil, fmt.Errorf("shards %d must be a power of 2 up to %d", shards, maxShards)
+	}
+
+	o, err := optionsOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ShardedFilter{
+		shards:     make([]*Filter, shards),
+		mask:       shards - 1,
+		transform:  o.transform,
+		maxKeySize: o.maxKeySize,
+		hashers:    hasherPool(murmurHash(o.seed ^ shardSeedMask)),
+	}
+
+	capacity := uint32((uint64(o.capacity) + uint64(shards) - 1) / uint64(shards))
+	for i := range s.shards {
+		// capped so the append never writes into the caller's options
+		s.shards[i], err = NewWithOptions(append(opts[:len(opts):len(opts)], WithCapacity(capacity))...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// defaultShards returns GOMAXPROCS rounded up to a power of 2
+func defaultShards() uint32 {
+	n := uint32(min(runtime.GOMAXPROCS(0), maxShards))
+	return 1 << bits.Len32(n-1)
+}
+
+// shardOf returns the shard of item x
+func (s *ShardedFilter) shardOf(x []byte) *Filter {
+	return s.shards[s.shardIndex(x)]
+}
+
+// shardIndex returns the index of the shard of item x. The key transform is
+// applied first, so items transformed to the same key share a shard. Items
+// past the max key size aren't hashed, the first shard rejects them
+func (s *ShardedFilter) shardIndex(x []byte) uint32 {
+	if s.maxKeySize > 0 && len(x) > s.maxKeySize {
+		return 0
+	}
+
+	if s.transform != nil {
+		x = s.transform(x)
+	}
+
+	h := s.hashers.Get().(*hasher)
+	defer s.hashers.Put(h)
+
+	return hashOf(x, h) & s.mask
+}
+
+// Insert inserts the item into its shard
+func (s *ShardedFilter) Insert(x []byte) bool {
+	return s.shardOf(x).Insert(x)
+}
+
+// InsertBatchParallel inserts the items, returning how many were inserted.
+// The items are grouped by shard in order, and workers goroutines insert the
+// groups, each holding the lock of one shard at a time, so the shards fill in
+// parallel
+func (s *ShardedFilter) InsertBatchParallel(items [][]byte, workers int) int {
+	groups := make([][][]byte, len(s.shards))
+	for _, x := range items {
+		i := s.shardIndex(x)
+		groups[i] = append(groups[i], x)
+	}
+
+	var n atomic.Int64
+	parallel(uint32(len(groups)), workers, func(c uint32) error {
+		n.Add(int64(s.shards[c].InsertBatchParallel(groups[c], 1)))
+		return nil
+	})
+
+	return int(n.Load())
+}
+
+// Lookup checks if the item exists in its shard
+func (s *ShardedFilter) Lookup(x []byte) bool {
+	return s.shardOf(x).Lookup(x)
+}
+
+// Delete deletes the item from its shard
+func (s *ShardedFilter) Delete(x []byte) bool {
+	return s.shardOf(x).Delete(x)
+}
+
+// Count returns the items held across every shard
+func (s *ShardedFilter) Count() uint32 {
+	var n uint32
+	for _, f := range s.shards {
+		n += f.Count()
+	}
+
+	return n
+}
+
+// LoadFactor returns the items held over the slots of every shard
+func (s *ShardedFilter) LoadFactor() float64 {
+	var n, slots uint64
+	for _, f := range s.shards {
+		f.L.RLock()
+		n += uint64(f.UCount())
+		slots += uint64(f.UCapacity())
+		f.L.RUnlock()
+	}
+
+	if slots == 0 {
+		return 0
+	}
+
+	return float64(n) / float64(slots)
+}
+
+// Shards returns the number of shards
+func (s *ShardedFilter) Shards() int {
+	return len(s.shards)
+}
@@ -0,0 +1,133 @@
+package cuckoo
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestShardedFilter(t *testing.T) {
+	s, err := NewShardedFilter(4, WithCapacity(1<<14))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var items [][]byte
+	for w := 0; w < 4; w++ {
+		var batch [][]byte
+		for i := 0; i < 2500; i++ {
+			batch = append(batch, []byte(fmt.Sprintf("item-%d-%d", w, i)))
+		}
+
+		items = append(items, batch...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, x := range batch {
+				if !s.Insert(x) {
+					t.Errorf("insert failed: %s", x)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	if s.Shards() != 4 || s.Count() != 10000 {
+		t.Fatalf("expected 10000 items over 4 shards but got %d over %d", s.Count(), s.Shards())
+	}
+
+	var slots uint32
+	for i, f := range s.shards {
+		if n := f.Count(); n < 2000 || n > 3000 {
+			t.Fatalf("expected a quarter of the items in shard %d but got %d", i, n)
+		}
+
+		slots += f.Capacity()
+	}
+
+	if lf := s.LoadFactor(); lf != 10000/float64(slots) {
+		t.Fatalf("expected %v load factor but got %v", 10000/float64(slots), lf)
+	}
+
+	for _, x := range items {
+		if !s.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	for _, x := range items {
+		if !s.Delete(x) {
+			t.Fatalf("delete failed: %s", x)
+		}
+	}
+
+	if s.Count() != 0 || s.LoadFactor() != 0 || s.Insert(nil) {
+		t.Fatalf("expected an empty filter rejecting empty items")
+	}
+
+	// transformed keys share a shard
+	s, _ = NewShardedFilter(16, WithKeyTransform(bytes.ToLower))
+	for i := 0; i < 100; i++ {
+		if !s.Insert([]byte(fmt.Sprintf("Item-%d", i))) || !s.Lookup([]byte(fmt.Sprintf("ITEM-%d", i))) {
+			t.Fatalf("expected lookups of the transformed key %d to find it", i)
+		}
+	}
+
+	// oversized keys are rejected by a shard without being hashed to one
+	s, _ = NewShardedFilter(4, WithMaxKeySize(4), WithKeyTransform(func(x []byte) []byte {
+		if len(x) > 4 {
+			t.Fatalf("expected %s to be rejected before the transform", x)
+		}
+
+		return x
+	}))
+	if s.Insert([]byte("too long")) || !s.Insert([]byte("ok")) {
+		t.Fatalf("expected only keys within the max key size to be inserted")
+	}
+
+	if s, _ := NewShardedFilter(0); !isPowerOf2(uint32(s.Shards())) {
+		t.Fatalf("expected the default shards to be a power of 2 but got %d", s.Shards())
+	}
+
+	for _, n := range []uint32{3, maxShards << 1} {
+		if _, err := NewShardedFilter(n); err == nil {
+			t.Fatalf("expected error for %d shards", n)
+		}
+	}
+}
+
+func TestShardedFilter_InsertBatchParallel(t *testing.T) {
+	// every shard kicks with a round robin strategy of its own, which the race
+	// detector would catch being shared
+	s, err := NewShardedFilter(4, WithCapacity(1<<12), WithBucketSize(2), WithVictimStrategyFunc(RoundRobinVictim))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var items [][]byte
+	for i := 0; i < 2000; i++ {
+		items = append(items, []byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	items = append(items, nil)
+	if n := s.InsertBatchParallel(items, 4); n != 2000 || s.Count() != 2000 {
+		t.Fatalf("expected 2000 items inserted but got %d with %d count", n, s.Count())
+	}
+
+	for _, x := range items[:2000] {
+		if !s.Lookup(x) {
+			t.Fatalf("lookup failed: %s", x)
+		}
+	}
+
+	var kicks uint64
+	for _, f := range s.shards {
+		kicks += f.Stats().Kicks
+	}
+
+	if kicks == 0 {
+		t.Fatalf("expected the shards to kick")
+	}
+}
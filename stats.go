@@ -0,0 +1,302 @@
+package cuckoo
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Stats are the insert counters of a filter since it was built or ResetStats
+type Stats struct {
+	// Inserts is the number of fingerprints placed in the filter
+	Inserts uint64
+
+	// Failures is the number of inserts that didn't fit
+	Failures uint64
+
+	// Kicks is the number of fingerprints kicked to their alternate bucket
+	Kicks uint64
+}
+
+// filterStats are the live counters behind Stats
+type filterStats struct {
+	inserts  atomic.Uint64
+	failures atomic.Uint64
+	kicks    atomic.Uint64
+
+	// recent are the outcomes of the last inserts for WithFailureWindow,
+	// updated under the write lock
+	recent *failureWindow
+}
+
+// record counts an insert that kicked kicks fingerprints
+func (s *filterStats) record(err error, kicks uint16) {
+	if err != nil {
+		s.failures.Add(1)
+	} else {
+		s.inserts.Add(1)
+	}
+
+	s.kicks.Add(uint64(kicks))
+	if s.recent != nil {
+		s.recent.add(err != nil)
+	}
+}
+
+// clear zeroes the counters
+func (s *filterStats) clear() {
+	s.inserts.Store(0)
+	s.failures.Store(0)
+	s.kicks.Store(0)
+	if s.recent != nil {
+		s.recent.clear()
+	}
+}
+
+// failureWindow is a ring buffer of whether each of the last inserts failed.
+// It's updated under the write lock, and counts packs its failures and
+// inserts so rate reads them atomically without it
+type failureWindow struct {
+	failed   []bool
+	next     int
+	n        int
+	failures int
+	counts   atomic.Uint64
+}
+
+// newFailureWindow returns a window over the last size inserts
+func newFailureWindow(size int) *failureWindow {
+	return &failureWindow{failed: make([]bool, size)}
+}
+
+// add records the outcome of an insert, evicting the oldest once full
+func (w *failureWindow) add(failed bool) {
+	if w.n == len(w.failed) {
+		if w.failed[w.next] {
+			w.failures--
+		}
+	} else {
+		w.n++
+	}
+
+	w.failed[w.next] = failed
+	if failed {
+		w.failures++
+	}
+
+	w.next = (w.next + 1) % len(w.failed)
+	w.counts.Store(uint64(w.failures)<<32 | uint64(w.n))
+}
+
+// rate returns the failed fraction of the inserts in the window
+func (w *failureWindow) rate() float64 {
+	c := w.counts.Load()
+	failures, n := uint32(c>>32), uint32(c)
+	if n == 0 {
+		return 0
+	}
+
+	return float64(failures) / float64(n)
+}
+
+// clear empties the window
+func (w *failureWindow) clear() {
+	clear(w.failed)
+	w.next, w.n, w.failures = 0, 0, 0
+	w.counts.Store(0)
+}
+
+// Stats returns the insert counters of the filter. Doesn't take the lock
+func (f *Filter) Stats() Stats {
+	return Stats{
+		Inserts:  f.stats.inserts.Load(),
+		Failures: f.stats.failures.Load(),
+		Kicks:    f.stats.kicks.Load(),
+	}
+}
+
+// ResetStats zeroes the insert counters, leaving the contents of the filter as they are
+func (f *Filter) ResetStats() {
+	f.L.Lock()
+	defer f.L.Unlock()
+
+	f.stats.clear()
+}
+
+// RecentFailureRate returns the fraction of the last inserts that failed, over
+// the window set by WithFailureWindow or as many inserts as were made since
+// the filter was built or ResetStats. Unlike the counters of Stats it follows
+// the current health of the filter, rising as it fills past what it can hold.
+// It's 0 without the option or before any insert. Doesn't take the lock
+func (f *Filter) RecentFailureRate() float64 {
+	return f.URecentFailureRate()
+}
+
+// URecentFailureRate returns the fraction of the last inserts that failed. Not thread safe
+func (f *Filter) URecentFailureRate() float64 {
+	if f.stats.recent == nil {
+		return 0
+	}
+
+	return f.stats.recent.rate()
+}
+
+// Weights and scale of SaturationScore
+const (
+	saturationLoadWeight    = 0.5
+	saturationFailureWeight = 0.3
+	saturationKickWeight    = 0.2
+
+	// saturationKicks is the average kicks per insert taken as fully saturated
+	saturationKicks = 32
+)
+
+// SaturationScore returns how close the filter is to needing a replacement,
+// from 0 for an empty filter to 1 for one that can't take more items:
+//
+//	0.5 * min(1, load factor / safe load of the bucket size) +
+//	0.3 * failures / (inserts + failures) +
+//	0.2 * min(1, kicks / (inserts + failures) / 32)
+//
+// The insert counters are those of Stats, so the failure and kick terms cover
+// the inserts since the filter was built or ResetStats, and resetting them
+// periodically makes the score follow recent inserts. Everything it's built
+// from is public, so callers wanting other weights can compute their own.
+// Doesn't take the lock
+func (f *Filter) SaturationScore() float64 {
+	bs, _ := loadGeometry(f)
+	load := math.Min(1, f.LoadFactor()/estimatedLoadFactor(bs))
+	st := f.Stats()
+	var failures, kicks float64
+	if attempts := float64(st.Inserts + st.Failures); attempts > 0 {
+		failures = float64(st.Failures) / attempts
+		kicks = math.Min(1, float64(st.Kicks)/attempts/saturationKicks)
+	}
+
+	return saturationLoadWeight*load + saturationFailureWeight*failures + saturationKickWeight*kicks
+}
+
+// Capacity returns the slots of the filter, the bucket size times the buckets.
+// Doesn't take the lock
+func (f *Filter) Capacity() uint32 {
+	bs, tb := loadGeometry(f)
+	return uint32(bs) * tb
+}
+
+// UCapacity returns the slots of the filter. Not thread safe
+func (f *Filter) UCapacity() uint32 {
+	return uint32(f.bucketSize) * f.totalBuckets
+}
+
+// FalsePositiveRate estimates the false positive rate of a lookup at the
+// current load. A lookup compares the fingerprint of an item against the
+// 2 * bucket size * load factor fingerprints expected in its buckets, so
+// it's 1 - (1 - 2^-fingerprint bits)^(2 * bucket size * load factor).
+// Doesn't take the lock
+func (f *Filter) FalsePositiveRate() float64 {
+	bs, _ := loadGeometry(f)
+	return falsePositiveRate(bs, f.LoadFactor())
+}
+
+// UFalsePositiveRate estimates the false positive rate of a lookup at the current load. Not thread safe
+func (f *Filter) UFalsePositiveRate() float64 {
+	return falsePositiveRate(f.bucketSize, f.ULoadFactor())
+}
+
+// falsePositiveRate returns the false positive rate of a lookup in buckets of
+// size bs at load factor lf
+func falsePositiveRate(bs uint8, lf float64) float64 {
+	compared := 2 * float64(bs) * lf
+	return 1 - math.Pow(1-math.Exp2(-fingerprintBits), compared)
+}
+
+// BucketLoad returns how many slots of the bucket at index are occupied, or
+// -1 if there's no such bucket. BucketsFor finds the buckets of an item
+func (f *Filter) BucketLoad(index uint32) int {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UBucketLoad(index)
+}
+
+// UBucketLoad returns how many slots of the bucket at index are occupied. Not thread safe
+func (f *Filter) UBucketLoad(index uint32) int {
+	if f.closed || index >= f.totalBuckets {
+		return -1
+	}
+
+	return bits.OnesCount16(f.buckets[index].Track)
+}
+
+// SlotInfo is an occupied slot of a bucket
+type SlotInfo struct {
+	// Slot is the index of the slot in its bucket
+	Slot int
+
+	// Fingerprint is the fingerprint held in the slot
+	Fingerprint Fingerprint
+
+	// AltBucket is the other bucket the fingerprint can be kicked to
+	AltBucket uint32
+}
+
+// BucketDetail returns the occupied slots of the bucket at index with the
+// alternate bucket of each fingerprint, or nil if there's no such bucket.
+// Following the alternate buckets retraces the kick chains through it
+func (f *Filter) BucketDetail(index uint32) []SlotInfo {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UBucketDetail(index)
+}
+
+// UBucketDetail returns the occupied slots of the bucket at index. Not thread safe
+func (f *Filter) UBucketDetail(index uint32) []SlotInfo {
+	if f.closed || index >= f.totalBuckets {
+		return nil
+	}
+
+	b := f.buckets[index]
+	slots := make([]SlotInfo, 0, bits.OnesCount16(b.Track))
+	for i := uint8(0); i < f.bucketSize; i++ {
+		if !isSet(b.Track, i) {
+			continue
+		}
+
+		fp := b.FPs[i]
+		slots = append(slots, SlotInfo{
+			Slot:        int(i),
+			Fingerprint: Fingerprint(fp),
+			AltBucket:   alternateIndex(f.indexing, f.totalBuckets, f.mask, index, altHash(f, fp)),
+		})
+	}
+
+	return slots
+}
+
+// FindFingerprint returns the indices of the buckets holding fp in ascending
+// order, to see which stored items an item's false positive collides with.
+// It scans every bucket, so it's meant for debugging. WouldCollide tells
+// whether two items collide without scanning
+func (f *Filter) FindFingerprint(fp Fingerprint) []uint32 {
+	f.L.RLock()
+	defer f.L.RUnlock()
+
+	return f.UFindFingerprint(fp)
+}
+
+// UFindFingerprint returns the indices of the buckets holding fp. Not thread safe
+func (f *Filter) UFindFingerprint(fp Fingerprint) []uint32 {
+	if fp >= 1<<fingerprintBits {
+		return nil
+	}
+
+	var indices []uint32
+	for i, b := range f.buckets {
+		if countIn(b, f.bucketSize, fingerprint(fp)) > 0 {
+			indices = append(indices, uint32(i))
+		}
+	}
+
+	return indices
+}
@@ -0,0 +1,231 @@
+package cuckoo
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFilter_Stats(t *testing.T) {
+	f := NewFilter(60)
+	for i := 0; i < 100; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	s := f.Stats()
+	if s.Inserts != uint64(f.Count()) || s.Inserts+s.Failures != 100 {
+		t.Fatalf("expected %d inserts of 100 but got %+v", f.Count(), s)
+	}
+
+	if s.Kicks == 0 {
+		t.Fatalf("expected a full filter to kick")
+	}
+
+	count := f.Count()
+	f.ResetStats()
+	if s := f.Stats(); s != (Stats{}) {
+		t.Fatalf("expected zero stats but got %+v", s)
+	}
+
+	if f.Count() != count {
+		t.Fatalf("expected contents to be kept")
+	}
+}
+
+func TestFilter_SaturationScore(t *testing.T) {
+	f := NewFilter(1000)
+	if s := f.SaturationScore(); s != 0 {
+		t.Fatalf("expected 0 for an empty filter but got %v", s)
+	}
+
+	var prev float64
+	for _, n := range []int{256, 512, 768, 2048} {
+		for i := int(f.Count()); i < n; i++ {
+			f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+		}
+
+		s := f.SaturationScore()
+		if s <= prev || s > 1 {
+			t.Fatalf("expected score to grow within 1 but got %v after %v", s, prev)
+		}
+
+		prev = s
+	}
+
+	if prev < 0.6 {
+		t.Fatalf("expected a full filter to be close to saturated but got %v", prev)
+	}
+}
+
+func TestFilter_BucketLoad(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for i := 0; i < 100; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	var total int
+	for i := uint32(0); i < f.totalBuckets; i++ {
+		n := f.BucketLoad(i)
+		if n < 0 || n > int(f.bucketSize) {
+			t.Fatalf("bucket %d: unexpected load %d", i, n)
+		}
+
+		total += n
+	}
+
+	if total != int(f.Count()) {
+		t.Fatalf("expected loads to add up to %d but got %d", f.Count(), total)
+	}
+
+	if n := f.BucketLoad(f.totalBuckets); n != -1 {
+		t.Fatalf("expected -1 out of range but got %d", n)
+	}
+}
+
+func TestFilter_BucketDetail(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for i := 0; i < 500; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	for i := 0; i < 500; i++ {
+		x := []byte(fmt.Sprintf("item-%d", i))
+		fp, i1, i2 := locate(f, x)
+		var found bool
+		for _, b := range [][2]uint32{{i1, i2}, {i2, i1}} {
+			for _, s := range f.BucketDetail(b[0]) {
+				if s.Fingerprint != Fingerprint(fp) {
+					continue
+				}
+
+				if s.AltBucket != b[1] || f.buckets[b[0]].FPs[s.Slot] != fp {
+					t.Fatalf("item %d: unexpected slot %+v in bucket %d", i, s, b[0])
+				}
+
+				found = true
+			}
+		}
+
+		if !found {
+			t.Fatalf("item %d: expected its fingerprint in its buckets", i)
+		}
+	}
+
+	if s := f.BucketDetail(f.totalBuckets); s != nil {
+		t.Fatalf("expected nil out of range but got %v", s)
+	}
+}
+
+func Test_failureWindow(t *testing.T) {
+	w := newFailureWindow(4)
+	tests := []struct {
+		failed bool
+		e      float64
+	}{
+		{failed: true, e: 1},
+		{failed: false, e: 0.5},
+		{failed: false, e: 1.0 / 3},
+		{failed: false, e: 0.25},
+		// the first failure drops out
+		{failed: false, e: 0},
+		{failed: true, e: 0.25},
+		{failed: true, e: 0.5},
+	}
+
+	for i, c := range tests {
+		w.add(c.failed)
+		if g := w.rate(); g != c.e {
+			t.Fatalf("insert %d: expected rate %v but got %v", i, c.e, g)
+		}
+	}
+}
+
+func TestFilter_RecentFailureRate(t *testing.T) {
+	f, err := NewWithOptions(WithCapacity(1<<8), WithFailureWindow(10))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; f.RecentFailureRate() < 1; i++ {
+		if i > 1<<12 {
+			t.Fatalf("expected inserts to keep failing past capacity")
+		}
+
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	if st := f.Stats(); st.Failures < 10 || float64(st.Failures)/float64(st.Inserts+st.Failures) >= 1 {
+		t.Fatalf("expected the window to only cover the last inserts but got %+v", st)
+	}
+
+	f.ResetStats()
+	if g := f.RecentFailureRate(); g != 0 {
+		t.Fatalf("expected 0 after reset but got %v", g)
+	}
+
+	if g := NewFilter(1 << 8).RecentFailureRate(); g != 0 {
+		t.Fatalf("expected 0 without the option but got %v", g)
+	}
+}
+
+func TestFilter_FindFingerprint(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for i := 0; i < 500; i++ {
+		f.Insert([]byte(fmt.Sprintf("item-%d", i)))
+	}
+
+	x := []byte("item-7")
+	fp, i1, i2 := locate(f, x)
+	indices := f.FindFingerprint(Fingerprint(fp))
+	var found bool
+	for j, i := range indices {
+		if j > 0 && indices[j-1] >= i {
+			t.Fatalf("expected ascending indices but got %v", indices)
+		}
+
+		if countIn(f.buckets[i], f.bucketSize, fp) == 0 {
+			t.Fatalf("expected bucket %d to hold fingerprint %d", i, fp)
+		}
+
+		found = found || i == i1 || i == i2
+	}
+
+	if !found {
+		t.Fatalf("expected one of buckets %d and %d in %v", i1, i2, indices)
+	}
+
+	f.Delete(x)
+	var n int
+	for _, b := range f.buckets {
+		n += countIn(b, f.bucketSize, fp)
+	}
+
+	if n == 0 && f.FindFingerprint(Fingerprint(fp)) != nil {
+		t.Fatalf("expected no buckets once the fingerprint is deleted")
+	}
+
+	// fingerprints wider than the filter stores are in no bucket
+	if indices := f.FindFingerprint(Fingerprint(fp) | 1<<fingerprintBits); indices != nil {
+		t.Fatalf("expected no buckets for a %d-bit fingerprint but got %v", fingerprintBits+1, indices)
+	}
+}
+
+func TestFilter_FalsePositiveRate(t *testing.T) {
+	f := NewFilter(64000)
+	if f.Capacity() != 1<<16 || f.FalsePositiveRate() != 0 {
+		t.Fatalf("expected %d slots and no false positives but got %d and %v", 1<<16, f.Capacity(), f.FalsePositiveRate())
+	}
+
+	f.fillTo(0.9)
+	var fp int
+	const lookups = 1 << 18
+	for i := 0; i < lookups; i++ {
+		if f.Lookup([]byte(fmt.Sprintf("non-member-%d", i))) {
+			fp++
+		}
+	}
+
+	estimate, measured := f.FalsePositiveRate(), float64(fp)/lookups
+	if measured < estimate/2 || measured > estimate*2 {
+		t.Fatalf("expected a false positive rate near %v but measured %v", estimate, measured)
+	}
+}
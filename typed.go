@@ -0,0 +1,39 @@
+package cuckoo
+
+import "encoding/binary"
+
+// InsertString inserts the string s, the same item as []byte(s)
+func (f *Filter) InsertString(s string) bool {
+	return f.Insert([]byte(s))
+}
+
+// LookupString checks if the string s exists in the filter
+func (f *Filter) LookupString(s string) bool {
+	return f.Lookup([]byte(s))
+}
+
+// DeleteString deletes the string s from the filter
+func (f *Filter) DeleteString(s string) bool {
+	return f.Delete([]byte(s))
+}
+
+// uint64Key returns v as an 8 byte big endian item. Every value is as long,
+// so none is padded and each maps to the same fingerprint on any platform
+func uint64Key(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, 8), v)
+}
+
+// InsertUint64 inserts v as an 8 byte big endian item
+func (f *Filter) InsertUint64(v uint64) bool {
+	return f.Insert(uint64Key(v))
+}
+
+// LookupUint64 checks if v exists in the filter
+func (f *Filter) LookupUint64(v uint64) bool {
+	return f.Lookup(uint64Key(v))
+}
+
+// DeleteUint64 deletes v from the filter
+func (f *Filter) DeleteUint64(v uint64) bool {
+	return f.Delete(uint64Key(v))
+}
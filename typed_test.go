@@ -0,0 +1,34 @@
+package cuckoo
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestFilter_typed(t *testing.T) {
+	f := NewFilter(1 << 10)
+	for _, s := range []string{"a", "gopher", "\x00"} {
+		if !f.InsertString(s) || !f.Lookup([]byte(s)) {
+			t.Fatalf("expected %q to be the same item as its bytes", s)
+		}
+
+		if !f.DeleteString(s) || f.LookupString(s) {
+			t.Fatalf("expected %q to be deleted", s)
+		}
+	}
+
+	for _, v := range []uint64{0, 1, 1 << 40, ^uint64(0)} {
+		x := binary.BigEndian.AppendUint64(nil, v)
+		if !f.InsertUint64(v) || !f.Lookup(x) {
+			t.Fatalf("expected %d to be the same item as its 8 big endian bytes", v)
+		}
+
+		if !f.DeleteUint64(v) || f.LookupUint64(v) {
+			t.Fatalf("expected %d to be deleted", v)
+		}
+	}
+
+	if f.Count() != 0 || f.InsertString("") {
+		t.Fatalf("expected an empty filter rejecting empty strings")
+	}
+}